@@ -0,0 +1,355 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// joinTokenAttempts and joinTokenInterval bound how long apply waits for
+// the first server to write the join token once RKE2 is started
+const (
+	joinTokenAttempts = 60
+	joinTokenInterval = 5 * time.Second
+)
+
+// MakeApply creates the apply command
+func MakeApply() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "apply",
+		Short: "Install a whole RKE2 cluster described by a plan file",
+		Long: `Install a whole RKE2 cluster described by a plan file. The first server
+is installed, then the remaining servers are joined one at a time, then
+the agents, and finally the kubeconfig is saved.
+
+` + SupportMsg,
+		Example: `  k2sup apply -f cluster.yaml
+
+  # cluster.yaml
+  channel: stable
+  vip: 192.168.20.200
+  registries: registries.yaml
+  ssh:
+    user: ubuntu
+    keys: [~/.ssh/id_ed25519]
+  servers:
+    - host: 192.168.20.10
+      config: server-config.yaml
+      taints: ["CriticalAddonsOnly=true:NoExecute"]
+    - host: 192.168.20.11
+    - host: 192.168.20.12
+  agents:
+    - host: 192.168.20.20
+      labels: ["disk=ssd"]`,
+		SilenceUsage: true,
+	}
+
+	command.Flags().StringP("file", "f", "", "The plan file describing the cluster")
+
+	addConnectionFlags(command)
+
+	command.Flags().Bool("wait", false, "Wait for each node to become Ready and its kube-system pods to run before reporting success")
+	command.Flags().Duration("wait-timeout", 10*time.Minute, "How long --wait waits for each node before failing with what it is blocked on")
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		fmt.Printf("Running: k2sup apply\n")
+
+		file, err := command.Flags().GetString("file")
+		if err != nil {
+			return err
+		}
+		if len(file) == 0 {
+			return fmt.Errorf("give the plan file with --file")
+		}
+
+		plan, err := loadPlan(expandPath(file))
+		if err != nil {
+			return err
+		}
+
+		dryRun, err := command.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+		printCommand, err := command.Flags().GetBool("print-command")
+		if err != nil {
+			return err
+		}
+		timeout, err := command.Flags().GetDuration("timeout")
+		if err != nil {
+			return err
+		}
+		waitTimeout, err := makeWaitTimeout(command)
+		if err != nil {
+			return err
+		}
+
+		if len(plan.SSH.Become) > 0 && !command.Flags().Changed("become") {
+			if err := command.Flags().Set("become", plan.SSH.Become); err != nil {
+				return err
+			}
+		}
+		passwords, err := readPasswords(command)
+		if err != nil {
+			return err
+		}
+		become, err := makeBecomeOptions(command, passwords.sudo)
+		if err != nil {
+			return err
+		}
+
+		openSSHConfig, err := loadSSHConfig(command)
+		if err != nil {
+			return err
+		}
+
+		// Resolve every node first so that a mistake in the plan is found
+		// before anything is installed
+		serverTargets := make([]operator.Target, len(plan.Servers))
+		for i, node := range plan.Servers {
+			if serverTargets[i], err = planTarget(command, openSSHConfig, plan.SSH, node); err != nil {
+				return err
+			}
+		}
+		agentTargets := make([]operator.Target, len(plan.Agents))
+		for i, node := range plan.Agents {
+			if agentTargets[i], err = planTarget(command, openSSHConfig, plan.SSH, node); err != nil {
+				return err
+			}
+		}
+
+		var connector *operator.Connector
+		if !dryRun {
+			connector, err = makeConnector(command, passwords.ssh)
+			if err != nil {
+				return err
+			}
+			defer connector.Close()
+		}
+
+		serverHost := serverTargets[0].Host
+
+		audit, err := makeAuditOptions(command, serverHost)
+		if err != nil {
+			return err
+		}
+		options := operatorOptions{
+			dryRun: dryRun,
+			become: become,
+			audit:  audit,
+		}
+
+		ctx := command.Context()
+		installer := rke2Installer{
+			version:      plan.Version,
+			channel:      plan.Channel,
+			scriptURL:    plan.InstallScript.URL,
+			scriptFile:   plan.InstallScript.File,
+			scriptSHA256: plan.InstallScript.SHA256,
+			method:       plan.installMethod(),
+			airgapDir:    plan.AirgapDir,
+		}
+
+		fmt.Printf("Installing server %s (1/%d)\n", serverHost, len(plan.Servers))
+		sshOperator, err := openOperator(ctx, connector, serverTargets[0], options)
+		if err != nil {
+			return errors.Wrapf(err, "unable to connect to %s", serverHost)
+		}
+		defer sshOperator.Close()
+
+		if err := makeConfigDir(sshOperator); err != nil {
+			return err
+		}
+		if err := uploadNodeConfig(sshOperator, plan.Servers[0]); err != nil {
+			return err
+		}
+		if err := setupServer(ctx, sshOperator, installer, plan.Servers[0].Config, plan.Registries, plan.VIP, plan.VIPInterface, printCommand, timeout); err != nil {
+			return errors.Wrapf(err, "unable to install %s", serverHost)
+		}
+		waiter := nodeWaiter{server: sshOperator, timeout: waitTimeout, dryRun: dryRun}
+		if waitTimeout > 0 {
+			if err := waiter.wait(ctx, sshOperator, os.Stdout, plan.Servers[0].Config); err != nil {
+				return err
+			}
+		}
+
+		joinToken, agentToken := dryRunJoinToken, dryRunJoinToken
+		if dryRun {
+			sshOperator.ExecuteStdio(getTokenCommand, false)
+			sshOperator.ExecuteStdio(getAgentTokenCommand, false)
+		} else {
+			fmt.Printf("Waiting for %s to write the join token...\n", serverHost)
+			if joinToken, err = readJoinToken(ctx, sshOperator, getTokenCommand, printCommand); err != nil {
+				return err
+			}
+			// Agents never receive the server token
+			if agentToken, err = readJoinToken(ctx, sshOperator, getAgentTokenCommand, printCommand); err != nil {
+				return err
+			}
+		}
+		options.audit.secrets = append(options.audit.secrets, joinToken, agentToken)
+
+		for i := 1; i < len(plan.Servers); i++ {
+			fmt.Printf("Joining server %s (%d/%d)\n", serverTargets[i].Host, i+1, len(plan.Servers))
+			err := joinPlanNode(ctx, connector, serverTargets[i], options, func(nodeOperator operator.Operator) error {
+				if err := setupAdditionalServer(ctx, nodeOperator, os.Stdout, installer, serverHost, joinToken, "", plan.Servers[i].Config, plan.Registries, printCommand, timeout); err != nil || waitTimeout == 0 {
+					return err
+				}
+				return waiter.wait(ctx, nodeOperator, os.Stdout, plan.Servers[i].Config)
+			}, plan.Servers[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := range plan.Agents {
+			fmt.Printf("Joining agent %s (%d/%d)\n", agentTargets[i].Host, i+1, len(plan.Agents))
+			err := joinPlanNode(ctx, connector, agentTargets[i], options, func(nodeOperator operator.Operator) error {
+				if err := setupAgent(ctx, nodeOperator, os.Stdout, installer, serverHost, agentToken, plan.Agents[i].Config, plan.Registries, printCommand, timeout); err != nil || waitTimeout == 0 {
+					return err
+				}
+				return waiter.wait(ctx, nodeOperator, os.Stdout, plan.Agents[i].Config)
+			}, plan.Agents[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		getConfigcommand := "cat " + rke2ConfigPath + "rke2.yaml\n"
+		if dryRun {
+			sshOperator.ExecuteStdio(getConfigcommand, false)
+			absPath, _ := filepath.Abs(plan.Kubeconfig)
+			fmt.Printf("Dry run: the kubeconfig would be saved to %s\n", absPath)
+			return nil
+		}
+
+		return obtainKubeconfig(ctx, sshOperator, getConfigcommand, serverHost, plan.VIP, plan.Context, plan.Kubeconfig, plan.Merge, false)
+	}
+
+	return command
+}
+
+// planTarget resolves node with the ssh config, settings given in the
+// plan take precedence, then flags which were set explicitly
+func planTarget(command *cobra.Command, config *operator.SSHConfig, settings planSSH, node planNode) (operator.Target, error) {
+	hostConfig := config.Lookup(node.Host)
+	target := operator.Target{
+		Host:     hostConfig.HostName,
+		User:     firstString(node.User, settings.User, hostConfig.User, "root"),
+		Port:     firstInt(node.Port, settings.Port, hostConfig.Port, 22),
+		KeyPaths: settings.Keys,
+	}
+	// Without keys the connector tries --ssh-key
+	if len(target.KeyPaths) == 0 && !command.Flags().Changed("ssh-key") {
+		target.KeyPaths = hostConfig.IdentityFiles
+	}
+
+	bastions, err := command.Flags().GetStringArray("bastion")
+	if err != nil {
+		return target, err
+	}
+	if len(settings.Bastions) > 0 {
+		bastions = settings.Bastions
+	} else if !command.Flags().Changed("bastion") {
+		bastions = hostConfig.ProxyJump
+	}
+
+	bastionKey, err := command.Flags().GetString("bastion-ssh-key")
+	if err != nil {
+		return target, err
+	}
+	for _, spec := range bastions {
+		bastion, err := resolveBastion(config, spec, target.User, bastionKey)
+		if err != nil {
+			return target, err
+		}
+		target.Bastions = append(target.Bastions, bastion)
+	}
+
+	return target, nil
+}
+
+// joinPlanNode connects to a node after the first server and runs setup
+// once its labels and taints are written
+func joinPlanNode(ctx context.Context, connector *operator.Connector, target operator.Target, options operatorOptions, setup func(operator.Operator) error, node planNode) error {
+	nodeOperator, err := openOperator(ctx, connector, target, options)
+	if err != nil {
+		return errors.Wrapf(err, "unable to connect to %s", target.Host)
+	}
+	defer nodeOperator.Close()
+
+	if err := uploadNodeConfig(nodeOperator, node); err != nil {
+		return err
+	}
+	if err := setup(nodeOperator); err != nil {
+		return errors.Wrapf(err, "unable to join %s", target.Host)
+	}
+	return nil
+}
+
+// uploadNodeConfig writes the labels and taints of node, if it has any
+func uploadNodeConfig(sshOperator operator.Operator, node planNode) error {
+	config := nodeConfig(node)
+	if len(config) == 0 {
+		return nil
+	}
+	if err := sshOperator.Upload(strings.NewReader(config), rke2NodeConfigFile, 0600, ""); err != nil {
+		return explainBecome(err)
+	}
+	return nil
+}
+
+// readJoinToken waits for the server to write the join token printed by
+// tokenCommand, which happens once RKE2 has started
+func readJoinToken(ctx context.Context, sshOperator operator.CommandOperator, tokenCommand string, printCommand bool) (string, error) {
+	if printCommand {
+		fmt.Printf("ssh: %s\n", tokenCommand)
+	}
+
+	for attempt := 1; ; attempt++ {
+		res, err := operator.ExecuteSecret(ctx, sshOperator, tokenCommand)
+		if err == nil {
+			if token := strings.TrimSpace(string(res.StdOut)); len(token) > 0 {
+				return token, nil
+			}
+			err = fmt.Errorf("the join token is empty")
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+		if attempt == joinTokenAttempts || err == operator.ErrPasswordRequired || err == operator.ErrPasswordIncorrect {
+			return "", commandFailed(err, res, "unable to get join-token from server")
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(joinTokenInterval):
+		}
+	}
+}
+
+func firstString(values ...string) string {
+	for _, value := range values {
+		if len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}
+
+func firstInt(values ...int) int {
+	for _, value := range values {
+		if value > 0 {
+			return value
+		}
+	}
+	return 0
+}
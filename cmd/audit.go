@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+)
+
+// auditOptions configures the transcript kept of every command run on
+// each host
+type auditOptions struct {
+	// dir is where the transcripts are written, none are kept when empty
+	dir     string
+	cluster string
+	started time.Time
+
+	// secrets are redacted from the transcripts
+	secrets []string
+}
+
+// makeAuditOptions reads --log-dir, the transcripts of each cluster are
+// kept apart in a directory named after its server
+func makeAuditOptions(command *cobra.Command, cluster string) (auditOptions, error) {
+	dir, err := command.Flags().GetString("log-dir")
+	if err != nil {
+		return auditOptions{}, err
+	}
+
+	return auditOptions{
+		dir:     expandPath(dir),
+		cluster: cluster,
+		started: time.Now(),
+	}, nil
+}
+
+// path returns the transcript for host, one is written for each run
+func (o auditOptions) path(host string) string {
+	name := fmt.Sprintf("%s-%s.log", host, o.started.UTC().Format("20060102T150405Z"))
+	return filepath.Join(o.dir, logPathSegment(o.cluster), logPathSegment(name))
+}
+
+// wrap returns op, keeping a transcript of it when --log-dir was given
+func (o auditOptions) wrap(op operator.Operator, host string) (operator.Operator, error) {
+	if len(o.dir) == 0 {
+		return op, nil
+	}
+
+	auditOperator, err := operator.NewAuditOperator(op, o.path(host), o.secrets)
+	if err != nil {
+		op.Close()
+		return nil, err
+	}
+	return auditOperator, nil
+}
+
+// logPathSegment makes name safe to use as a single path segment, such
+// as an IPv6 address or a host alias
+func logPathSegment(name string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(name)
+}
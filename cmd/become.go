@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// becomeOptions configures how commands are run as root on every host
+type becomeOptions struct {
+	method   string
+	password string
+}
+
+// becomeOperator is implemented by operators which can run commands as
+// root
+type becomeOperator interface {
+	SetBecome(method string) error
+	SetBecomePassword(password string)
+}
+
+func (o becomeOptions) apply(op becomeOperator) error {
+	if err := op.SetBecome(o.method); err != nil {
+		return err
+	}
+	op.SetBecomePassword(o.password)
+	return nil
+}
+
+// makeBecomeOptions reads --become, or --sudo when it is not given. The
+// password is from --sudo-password-stdin or K2SUP_SUDO_PASSWORD, see
+// readPasswords, or else from --sudo-askpass.
+func makeBecomeOptions(command *cobra.Command, password string) (becomeOptions, error) {
+	useSudo, err := command.Flags().GetBool("sudo")
+	if err != nil {
+		return becomeOptions{}, err
+	}
+	method, err := command.Flags().GetString("become")
+	if err != nil {
+		return becomeOptions{}, err
+	}
+	passwordStdin, err := command.Flags().GetBool("sudo-password-stdin")
+	if err != nil {
+		return becomeOptions{}, err
+	}
+	askpassProgram, err := command.Flags().GetString("sudo-askpass")
+	if err != nil {
+		return becomeOptions{}, err
+	}
+
+	if len(method) == 0 {
+		method = operator.BecomeSudo
+		if !useSudo {
+			method = operator.BecomeNone
+		}
+	} else if !useSudo && method != operator.BecomeNone {
+		return becomeOptions{}, fmt.Errorf("--sudo=false cannot be used with --become=%s", method)
+	}
+
+	options := becomeOptions{
+		method:   method,
+		password: password,
+	}
+	if method == operator.BecomeNone {
+		return options, nil
+	}
+
+	if !passwordStdin && len(askpassProgram) > 0 {
+		prompt := fmt.Sprintf("[%s] password: ", method)
+		if options.password, err = askpass(expandPath(askpassProgram), prompt); err != nil {
+			return options, errors.Wrapf(err, "unable to get the password to become root from %s", askpassProgram)
+		}
+	}
+
+	return options, nil
+}
+
+// askpass runs program with prompt as its only argument, in the same way
+// as SSH_ASKPASS, and returns the first line it prints
+func askpass(program, prompt string) (string, error) {
+	cmd := exec.Command(program, prompt)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.SplitN(strings.TrimRight(string(out), "\r\n"), "\n", 2)[0], nil
+}
+
+// explainBecome adds the flags to use to an error about the password to
+// become root
+func explainBecome(err error) error {
+	switch err {
+	case operator.ErrPasswordRequired:
+		return fmt.Errorf("%s, give it with --sudo-password-stdin, K2SUP_SUDO_PASSWORD or --sudo-askpass, or log in as root with --become=none", err)
+	case operator.ErrPasswordIncorrect:
+		return fmt.Errorf("%s, check the password given with --sudo-password-stdin, K2SUP_SUDO_PASSWORD or --sudo-askpass", err)
+	}
+	return err
+}
@@ -1,7 +1,7 @@
 package cmd
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -9,7 +9,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"time"
 
@@ -18,9 +17,6 @@ import (
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
-	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/crypto/ssh/terminal"
 )
 
 var kubeconfig []byte
@@ -32,13 +28,23 @@ var kubeconfig []byte
 // https://update.rke2.io/v1-release/channels
 const PinnedChannel = "stable"
 
-const getScript = "curl -sfL https://get.rke2.io"
+// defaultInstallScriptURL is where the RKE2 install script is downloaded
+// from unless --install-script-url or --install-script-file is given
+const defaultInstallScriptURL = "https://get.rke2.io"
 
 const rke2ConfigPath = "/etc/rancher/rke2/"
 const rke2ConfigFile = rke2ConfigPath + "config.yaml"
 const rke2ManifestsDir = "/var/lib/rancher/rke2/server/manifests"
 const containerdRegistriesFile = rke2ConfigPath + "registries.yaml"
 
+// makeConfigDir creates rke2ConfigPath on the node
+func makeConfigDir(sshOperator operator.CommandOperator) error {
+	if res, err := sshOperator.ExecuteStdio("mkdir -p "+rke2ConfigPath, false); err != nil {
+		return commandFailed(err, res, "unable to create "+rke2ConfigPath)
+	}
+	return nil
+}
+
 const kubeVipManifest = `---
 apiVersion: v1
 kind: ServiceAccount
@@ -165,10 +171,12 @@ func MakeInstall() *cobra.Command {
 	command.Flags().String("host", "", "Public hostname of node on which to install agent")
 	command.Flags().String("host-ip", "", "Public hostname of an existing RKE2 server")
 
-	command.Flags().String("ssh-key", "~/.ssh/id_rsa", "The ssh key to use for remote login")
 	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
-	command.Flags().Bool("sudo", true, "Use sudo for installation. e.g. set to false when using the root user and no sudo is available.")
+
+	addConnectionFlags(command)
+
 	command.Flags().Bool("skip-install", false, "Skip the RKE2 installer")
+	command.Flags().Bool("local", false, "Install on this machine rather than over SSH, e.g. from cloud-init or a CI runner")
 	command.Flags().Bool("print-kubeconfig", false, "Print the kubeconfig obtained from the server after installation")
 
 	command.Flags().String("local-path", "kubeconfig", "Local path to save the kubeconfig file")
@@ -177,12 +185,20 @@ func MakeInstall() *cobra.Command {
 	command.Flags().Bool("merge", false, `Merge the new kubeconfig with an existing kubeconfig if it already exists.
 Provide the --local-path flag with --merge if a kubeconfig already exists in some other directory`)
 
-	command.Flags().Bool("print-command", false, "Print a command that you can use with SSH to manually recover from an error")
+	command.Flags().Bool("wait", false, "Wait for each node to become Ready and its kube-system pods to run before reporting success")
+	command.Flags().Duration("wait-timeout", 10*time.Minute, "How long --wait waits for each node before failing with what it is blocked on")
 
 	command.Flags().String("version", "", "Set a version to install, overrides channel")
 	command.Flags().String("channel", PinnedChannel, "Release channel: stable, latest, v1.18, v1.19, v1.20, v1.21")
 	command.Flags().String("config", "", "RKE2 configuration file to use")
 	command.Flags().String("registries", "", "Specify a containerd registry configuration file to use")
+	command.Flags().String("install-script-url", defaultInstallScriptURL, "Download the RKE2 install script from this URL on the node, such as an internal mirror")
+	command.Flags().String("install-script-file", "", "Upload this copy of the RKE2 install script rather than downloading it on the node")
+	command.Flags().String("install-script-sha256", "", "The SHA-256 checksum of the install script, which is verified on the node before it is run")
+	command.Flags().String("install-method", installMethodAuto, "How the install script installs RKE2: auto, tar or rpm (auto uses rpm on RHEL-family hosts)")
+	command.Flags().String("install-tar-prefix", "", "Where a tar install puts RKE2, e.g. /opt/rke2 when /usr/local is read-only (Default /usr/local)")
+	command.Flags().String("rpm-repo-url", "", "An https:// mirror of rpm.rancher.io used by the rpm install method")
+	command.Flags().String("airgap-dir", "", "Install without internet access from a directory holding install.sh, the rke2 tarball, its sha256sum file and image tarballs, which are uploaded for the architecture of the node")
 	command.Flags().String("vip", "", "Specify a virtual IP (VIP) to use for the control plane")
 	command.Flags().String("vip-interface", "eth0", "Specify the network interface to use for the VIP")
 
@@ -209,26 +225,21 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 			return err
 		}
 
-		useSudo, err := command.Flags().GetBool("sudo")
+		passwords, err := readPasswords(command)
 		if err != nil {
 			return err
 		}
-
-		printConfig, err := command.Flags().GetBool("print-kubeconfig")
+		become, err := makeBecomeOptions(command, passwords.sudo)
 		if err != nil {
 			return err
 		}
 
-		sudoPrefix := ""
-		if useSudo {
-			sudoPrefix = "sudo "
-		}
-
-		rke2Version, err := command.Flags().GetString("version")
+		printConfig, err := command.Flags().GetBool("print-kubeconfig")
 		if err != nil {
 			return err
 		}
-		rke2Channel, err := command.Flags().GetString("channel")
+
+		installer, err := makeInstaller(command)
 		if err != nil {
 			return err
 		}
@@ -250,6 +261,14 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 		if err != nil {
 			return err
 		}
+		timeout, err := command.Flags().GetDuration("timeout")
+		if err != nil {
+			return err
+		}
+		waitTimeout, err := makeWaitTimeout(command)
+		if err != nil {
+			return err
+		}
 
 		merge, err := command.Flags().GetBool("merge")
 		if err != nil {
@@ -280,125 +299,72 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 			return err
 		}
 
-		installRKE2Exec := "INSTALL_RKE2_EXEC='server'"
+		getConfigcommand := "cat " + rke2ConfigPath + "rke2.yaml\n"
 
-		if len(rke2Version) == 0 && len(rke2Channel) == 0 {
-			return fmt.Errorf("give a value for --version or --channel")
+		local, err := command.Flags().GetBool("local")
+		if err != nil {
+			return err
 		}
-
-		installStr := createVersionStr(rke2Version, rke2Channel)
-
-		installRKE2command := fmt.Sprintf("%s | %s %s %s sh -\n", getScript, sudoPrefix, installRKE2Exec, installStr)
-		ensureSystemdcommand := fmt.Sprint(sudoPrefix + "systemctl enable --no-block --now rke2-server")
-
-		getConfigcommand := fmt.Sprintf(sudoPrefix + "cat " + rke2ConfigPath + "rke2.yaml\n")
-
-		port, _ := command.Flags().GetInt("ssh-port")
-
-		fmt.Println("Public IP: " + host)
-
-		user, _ := command.Flags().GetString("user")
-		sshKey, _ := command.Flags().GetString("ssh-key")
-
-		sshKeyPath := expandPath(sshKey)
-		address := fmt.Sprintf("%s:%d", host, port)
-
-		var sshOperator *operator.SSHOperator
-		var sshConfig *ssh.ClientConfig
-
-		var initialSSHErr error
-		if runtime.GOOS != "windows" {
-
-			var sshAgentAuthMethod ssh.AuthMethod
-			sshAgentAuthMethod, initialSSHErr = sshAgentOnly()
-			if initialSSHErr == nil {
-				// Try SSH agent without parsing key files, will succeed if the user
-				// has already added a key to the SSH Agent, or if using a configured
-				// smartcard
-				sshConfig = &ssh.ClientConfig{
-					User:            user,
-					Auth:            []ssh.AuthMethod{sshAgentAuthMethod},
-					HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-				}
-
-				sshOperator, initialSSHErr = operator.NewSSHOperator(address, sshConfig)
-			}
-		} else {
-			initialSSHErr = errors.New("ssh-agent unsupported on windows")
+		dryRun, err := command.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
 		}
 
-		// If the initial connection attempt fails fall through to the using
-		// the supplied/default private key file
-		if initialSSHErr != nil {
-			publicKeyFileAuth, closeSSHAgent, err := loadPublickey(sshKeyPath)
+		var connector *operator.Connector
+		target := operator.Target{}
+		if !local {
+			openSSHConfig, err := loadSSHConfig(command)
 			if err != nil {
-				return errors.Wrapf(err, "unable to load the ssh key with path %q", sshKeyPath)
+				return err
 			}
 
-			defer closeSSHAgent()
-
-			sshConfig = &ssh.ClientConfig{
-				User:            user,
-				Auth:            []ssh.AuthMethod{publicKeyFileAuth},
-				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			target, err = resolveSSHTarget(command, openSSHConfig, host, []string{"user"}, []string{"ssh-port"})
+			if err != nil {
+				return err
 			}
+			host = target.Host
+		}
 
-			sshOperator, err = operator.NewSSHOperator(address, sshConfig)
-
+		if !local && !dryRun {
+			connector, err = makeConnector(command, passwords.ssh)
 			if err != nil {
-				return errors.Wrapf(err, "unable to connect to %s over ssh", address)
+				return err
 			}
+			defer connector.Close()
 		}
 
-		defer sshOperator.Close()
-
-		sshOperator.Execute(fmt.Sprintf("%s mkdir -p "+rke2ConfigPath, sudoPrefix))
+		fmt.Println("Public IP: " + host)
 
-		if !skipInstall {
-			if vip != "" {
-				vipReplace := strings.NewReplacer(
-					".VIP", vip,
-					".INTERFACE", vipInterface,
-				)
-				m := vipReplace.Replace(kubeVipManifest)
-				vipConfig := fmt.Sprintf("echo '%s' | %s tee %s/vip.yaml >/dev/null", m, sudoPrefix, rke2ManifestsDir)
-				sshOperator.Execute(fmt.Sprintf("%s mkdir -p %s", sudoPrefix, rke2ManifestsDir))
-				_, err := sshOperator.Execute(vipConfig)
-				if err != nil {
-					return err
-				}
-			}
+		audit, err := makeAuditOptions(command, host)
+		if err != nil {
+			return err
+		}
 
-			if configFile != "" {
-				f, err := os.Open(configFile)
-				if err != nil {
-					return errors.Wrapf(err, "unable to open specified config file %q", configFile)
-				}
-				defer f.Close()
-				sshOperator.CopySCP(f, rke2ConfigFile)
-			}
+		sshOperator, err := openOperator(command.Context(), connector, target, operatorOptions{
+			local:  local,
+			dryRun: dryRun,
+			become: become,
+			audit:  audit,
+		})
+		if err != nil {
+			return err
+		}
 
-			if registriesFile != "" {
-				f, err := os.Open(registriesFile)
-				if err != nil {
-					return errors.Wrapf(err, "unable to open specified config file %q", registriesFile)
-				}
-				defer f.Close()
-				sshOperator.CopySCP(f, containerdRegistriesFile)
-			}
+		defer sshOperator.Close()
 
-			if printCommand {
-				fmt.Printf("ssh: %s\n", installRKE2command)
-			}
+		if err := makeConfigDir(sshOperator); err != nil {
+			return err
+		}
 
-			_, err := sshOperator.Execute(installRKE2command)
-			if err != nil {
-				return fmt.Errorf("error received processing command: %s", err)
+		if !skipInstall {
+			if err := setupServer(command.Context(), sshOperator, installer, configFile, registriesFile, vip, vipInterface, printCommand, timeout); err != nil {
+				return err
 			}
+		}
 
-			fmt.Printf("🐌 Enabling and starting RKE2, please wait while services initialise...\n")
-			_, err = sshOperator.Execute(ensureSystemdcommand)
-			if err != nil {
+		if waitTimeout > 0 {
+			waiter := nodeWaiter{server: sshOperator, timeout: waitTimeout, dryRun: dryRun}
+			if err := waiter.wait(command.Context(), sshOperator, os.Stdout, configFile); err != nil {
 				return err
 			}
 		}
@@ -406,10 +372,21 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 		if printCommand {
 			fmt.Printf("ssh: %s\n", getConfigcommand)
 		}
+
+		if dryRun {
+			sshOperator.ExecuteStdio(getConfigcommand, false)
+			absPath, _ := filepath.Abs(localKubeconfig)
+			fmt.Printf("Dry run: the kubeconfig would be saved to %s\n", absPath)
+			return nil
+		}
+
 		// Give some time for RKE2 to start and generate our kubeconfig file
 		r := 0
 		for r < 5 {
-			err = obtainKubeconfig(sshOperator, getConfigcommand, host, vip, context, localKubeconfig, merge, printConfig)
+			if err := command.Context().Err(); err != nil {
+				return err
+			}
+			err = obtainKubeconfig(command.Context(), sshOperator, getConfigcommand, host, vip, context, localKubeconfig, merge, printConfig)
 			if err != nil {
 				r++
 				time.Sleep(2 * time.Second)
@@ -434,18 +411,73 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 	return command
 }
 
-func sshAgentOnly() (ssh.AuthMethod, error) {
-	sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+// setupServer installs and starts the first RKE2 server of a cluster
+func setupServer(ctx context.Context, sshOperator operator.Operator, installer rke2Installer, configFile, registriesFile, vip, vipInterface string, printCommand bool, timeout time.Duration) error {
+	ensureSystemdcommand := "systemctl enable --no-block --now rke2-server"
+
+	if vip != "" {
+		vipReplace := strings.NewReplacer(
+			".VIP", vip,
+			".INTERFACE", vipInterface,
+		)
+		m := vipReplace.Replace(kubeVipManifest)
+		vipConfig := fmt.Sprintf("echo '%s' | tee %s/vip.yaml >/dev/null", m, rke2ManifestsDir)
+		sshOperator.Execute("mkdir -p " + rke2ManifestsDir)
+		res, err := executePhase(ctx, sshOperator, timeout, vipConfig)
+		if err != nil {
+			return commandFailed(err, res, "unable to write the kube-vip manifest")
+		}
+	}
+
+	if configFile != "" {
+		f, err := os.Open(configFile)
+		if err != nil {
+			return errors.Wrapf(err, "unable to open specified config file %q", configFile)
+		}
+		defer f.Close()
+		if err := sshOperator.Upload(f, rke2ConfigFile, 0600, ""); err != nil {
+			return explainBecome(err)
+		}
+	}
+
+	if registriesFile != "" {
+		f, err := os.Open(registriesFile)
+		if err != nil {
+			return errors.Wrapf(err, "unable to open specified config file %q", registriesFile)
+		}
+		defer f.Close()
+		if err := sshOperator.Upload(f, containerdRegistriesFile, 0600, ""); err != nil {
+			return explainBecome(err)
+		}
+	}
+
+	installRKE2command, err := installer.command(ctx, sshOperator, os.Stdout, "INSTALL_RKE2_EXEC='server'")
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if printCommand {
+		fmt.Printf("ssh: %s\n", installRKE2command)
+	}
+
+	res, err := executePhase(ctx, sshOperator, timeout, installRKE2command)
+	if err != nil {
+		return installFailed(err, res, "error received processing command")
+	}
+
+	fmt.Printf("🐌 Enabling and starting RKE2, please wait while services initialise...\n")
+	res, err = executePhase(ctx, sshOperator, timeout, ensureSystemdcommand)
+	if err != nil {
+		return commandFailed(err, res, "unable to start rke2-server")
 	}
-	return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers), nil
+
+	return nil
 }
 
-func obtainKubeconfig(operator operator.CommandOperator, getConfigcommand, host, vip, context, localKubeconfig string, merge, printConfig bool) error {
-	res, err := operator.ExecuteStdio(getConfigcommand, false)
+func obtainKubeconfig(ctx context.Context, operator operator.CommandOperator, getConfigcommand, host, vip, context, localKubeconfig string, merge, printConfig bool) error {
+	res, err := operator.ExecuteStdioContext(ctx, getConfigcommand, false)
 	if err != nil {
-		return fmt.Errorf("error received processing command: %s", err)
+		return commandFailed(err, res, "error received processing command")
 	}
 
 	if printConfig {
@@ -540,78 +572,6 @@ func expandPath(path string) string {
 	return res
 }
 
-func sshAgent(publicKeyPath string) (ssh.AuthMethod, func() error) {
-	if sshAgentConn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
-		sshAgent := agent.NewClient(sshAgentConn)
-
-		keys, _ := sshAgent.List()
-		if len(keys) == 0 {
-			return nil, sshAgentConn.Close
-		}
-
-		pubkey, err := ioutil.ReadFile(publicKeyPath)
-		if err != nil {
-			return nil, sshAgentConn.Close
-		}
-
-		authkey, _, _, _, err := ssh.ParseAuthorizedKey(pubkey)
-		if err != nil {
-			return nil, sshAgentConn.Close
-		}
-		parsedkey := authkey.Marshal()
-
-		for _, key := range keys {
-			if bytes.Equal(key.Blob, parsedkey) {
-				return ssh.PublicKeysCallback(sshAgent.Signers), sshAgentConn.Close
-			}
-		}
-	}
-	return nil, func() error { return nil }
-}
-
-func loadPublickey(path string) (ssh.AuthMethod, func() error, error) {
-	noopCloseFunc := func() error { return nil }
-
-	key, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, noopCloseFunc, fmt.Errorf("unable to read file: %s, %s", path, err)
-	}
-
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		if _, ok := err.(*ssh.PassphraseMissingError); !ok {
-			return nil, noopCloseFunc, fmt.Errorf("unable to parse private key: %s", err.Error())
-		}
-
-		agent, close := sshAgent(path + ".pub")
-		if agent != nil {
-			return agent, close, nil
-		}
-
-		defer close()
-
-		fmt.Printf("Enter passphrase for '%s': ", path)
-		STDIN := int(os.Stdin.Fd())
-		bytePassword, _ := terminal.ReadPassword(STDIN)
-
-		// Ignore any error from reading stdin to retain existing behaviour for unit test in
-		// install_test.go
-
-		// if err != nil {
-		// 	return nil, noopCloseFunc, fmt.Errorf("reading password from stdin failed: %s", err.Error())
-		// }
-
-		fmt.Println()
-
-		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, bytePassword)
-		if err != nil {
-			return nil, noopCloseFunc, fmt.Errorf("parse private key with passphrase failed: %s", err)
-		}
-	}
-
-	return ssh.PublicKeys(signer), noopCloseFunc, nil
-}
-
 func rewriteKubeconfig(kubeconfig string, host string, context string) []byte {
 	if context == "" {
 		context = "default"
@@ -0,0 +1,405 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// airgapArtifactsPath is where the artifacts for an air-gapped
+// installation are uploaded on each node
+const airgapArtifactsPath = "/root/rke2-artifacts"
+
+// installScriptPath is where the install script is written on a node
+// when it is uploaded or has to be verified before it is run
+const installScriptPath = "/root/rke2-install.sh"
+
+// rke2Installer describes how the RKE2 install script is run on a node
+type rke2Installer struct {
+	version string
+	channel string
+
+	// scriptURL is downloaded on the node, unless scriptFile is given
+	// which is uploaded instead
+	scriptURL  string
+	scriptFile string
+	// scriptSHA256 is verified on the node before the script is run
+	scriptSHA256 string
+
+	method installMethod
+
+	// airgapDir holds the artifacts uploaded to nodes without internet
+	// access, see airgapArtifacts
+	airgapDir string
+}
+
+// Install methods accepted by the RKE2 install script, auto lets it pick
+// rpm on RHEL-family hosts and tar elsewhere
+const (
+	installMethodAuto = "auto"
+	installMethodTar  = "tar"
+	installMethodRPM  = "rpm"
+)
+
+// installMethod chooses how the install script installs RKE2
+type installMethod struct {
+	method string
+
+	// tarPrefix is where a tarball install is unpacked, such as /opt/rke2
+	// when /usr/local is read-only
+	tarPrefix string
+
+	// rpmRepoURL replaces rpm.rancher.io for an rpm install
+	rpmRepoURL string
+}
+
+// validate checks that the settings apply to the chosen method
+func (m installMethod) validate(airgap bool) error {
+	switch m.method {
+	case "", installMethodAuto, installMethodTar, installMethodRPM:
+	default:
+		return fmt.Errorf("unknown install method %q, give auto, tar or rpm", m.method)
+	}
+
+	if len(m.tarPrefix) > 0 {
+		if m.method == installMethodRPM {
+			return fmt.Errorf("a tar prefix cannot be used with the rpm install method")
+		}
+		if !path.IsAbs(m.tarPrefix) {
+			return fmt.Errorf("the tar prefix %q must be an absolute path", m.tarPrefix)
+		}
+	}
+	if len(m.rpmRepoURL) > 0 {
+		if m.method == installMethodTar {
+			return fmt.Errorf("an RPM repository cannot be used with the tar install method")
+		}
+		if _, err := rpmSite(m.rpmRepoURL); err != nil {
+			return err
+		}
+	}
+	if airgap && (m.method == installMethodRPM || len(m.rpmRepoURL) > 0) {
+		return fmt.Errorf("air-gapped installs always use the tar install method")
+	}
+
+	return nil
+}
+
+// env returns the install script variables for the method
+func (m installMethod) env() string {
+	words := []string{}
+	if len(m.method) > 0 && m.method != installMethodAuto {
+		words = append(words, "INSTALL_RKE2_METHOD="+operator.ShellQuote(m.method))
+	}
+	if len(m.tarPrefix) > 0 {
+		words = append(words, "INSTALL_RKE2_TAR_PREFIX="+operator.ShellQuote(m.tarPrefix))
+	}
+	if len(m.rpmRepoURL) > 0 {
+		// validate has already checked the URL
+		site, _ := rpmSite(m.rpmRepoURL)
+		words = append(words, "INSTALL_RKE2_RPM_SITE="+operator.ShellQuote(site))
+	}
+	return joinWords(words...)
+}
+
+// rpmSite returns the host and path of an RPM repository URL, as the
+// install script builds https://<site>/rke2/<channel>/... from it
+func rpmSite(repoURL string) (string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Scheme != "https" || len(u.Host) == 0 {
+		return "", fmt.Errorf("invalid RPM repository URL %q, give an https:// URL such as https://rpm.example.com", repoURL)
+	}
+	return strings.TrimSuffix(u.Host+u.Path, "/"), nil
+}
+
+// makeInstaller reads the flags shared by install and join which choose
+// what is installed and how
+func makeInstaller(command *cobra.Command) (rke2Installer, error) {
+	version, err := command.Flags().GetString("version")
+	if err != nil {
+		return rke2Installer{}, err
+	}
+	channel, err := command.Flags().GetString("channel")
+	if err != nil {
+		return rke2Installer{}, err
+	}
+	scriptURL, err := command.Flags().GetString("install-script-url")
+	if err != nil {
+		return rke2Installer{}, err
+	}
+	scriptFile, err := command.Flags().GetString("install-script-file")
+	if err != nil {
+		return rke2Installer{}, err
+	}
+	scriptSHA256, err := command.Flags().GetString("install-script-sha256")
+	if err != nil {
+		return rke2Installer{}, err
+	}
+	method, err := command.Flags().GetString("install-method")
+	if err != nil {
+		return rke2Installer{}, err
+	}
+	tarPrefix, err := command.Flags().GetString("install-tar-prefix")
+	if err != nil {
+		return rke2Installer{}, err
+	}
+	rpmRepoURL, err := command.Flags().GetString("rpm-repo-url")
+	if err != nil {
+		return rke2Installer{}, err
+	}
+	airgapDir, err := command.Flags().GetString("airgap-dir")
+	if err != nil {
+		return rke2Installer{}, err
+	}
+
+	if len(version) == 0 && len(channel) == 0 {
+		return rke2Installer{}, fmt.Errorf("give a value for --version or --channel")
+	}
+	if command.Flags().Changed("install-script-url") && len(scriptFile) > 0 {
+		return rke2Installer{}, fmt.Errorf("give only one of --install-script-url and --install-script-file")
+	}
+	if len(airgapDir) > 0 && (command.Flags().Changed("install-script-url") || len(scriptFile) > 0) {
+		return rke2Installer{}, fmt.Errorf("--airgap-dir uses the install.sh in the directory, --install-script-url and --install-script-file cannot be used with it")
+	}
+
+	installer := rke2Installer{
+		version:    version,
+		channel:    channel,
+		scriptURL:  scriptURL,
+		scriptFile: expandPath(scriptFile),
+		method: installMethod{
+			method:     method,
+			tarPrefix:  tarPrefix,
+			rpmRepoURL: rpmRepoURL,
+		},
+		airgapDir: expandPath(airgapDir),
+	}
+	if err := installer.method.validate(len(installer.airgapDir) > 0); err != nil {
+		return installer, err
+	}
+	if len(scriptSHA256) > 0 {
+		if installer.scriptSHA256, err = parseSHA256(scriptSHA256); err != nil {
+			return installer, err
+		}
+	}
+	if len(installer.scriptFile) > 0 {
+		if _, err := os.Stat(installer.scriptFile); err != nil {
+			return installer, errors.Wrap(err, "unable to read --install-script-file")
+		}
+	}
+	if len(installer.airgapDir) > 0 {
+		if _, err := ioutil.ReadDir(installer.airgapDir); err != nil {
+			return installer, errors.Wrap(err, "unable to read --airgap-dir")
+		}
+	}
+
+	return installer, nil
+}
+
+// parseSHA256 checks that sum is a hex encoded SHA-256 checksum
+func parseSHA256(sum string) (string, error) {
+	sum = strings.ToLower(strings.TrimSpace(sum))
+	if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("invalid --install-script-sha256 %q, give the 64 hex digits printed by sha256sum", sum)
+	}
+	return sum, nil
+}
+
+// command prepares the node and returns the command which runs the
+// install script, with env such as INSTALL_RKE2_TYPE='server' set
+func (i rke2Installer) command(ctx context.Context, sshOperator operator.Operator, out io.Writer, env string) (string, error) {
+	if len(i.airgapDir) > 0 {
+		return i.airgapCommand(ctx, sshOperator, out, env)
+	}
+
+	versionEnv := createVersionStr(i.version, i.channel, i.method)
+	download := ""
+
+	switch {
+	case len(i.scriptFile) > 0:
+		if err := uploadFile(sshOperator, out, i.scriptFile, installScriptPath, 0700); err != nil {
+			return "", err
+		}
+	case len(i.scriptSHA256) > 0:
+		download = joinWords("curl -sfL", operator.ShellQuote(i.scriptURL), "-o", installScriptPath)
+	default:
+		return joinWords("curl -sfL", operator.ShellQuote(i.scriptURL), "|", versionEnv, env, "sh -s -"), nil
+	}
+
+	// The script is removed however the command ends
+	cleanup := "trap " + operator.ShellQuote("rm -f "+installScriptPath) + " EXIT; "
+	return cleanup + andCommands(download, verifyScriptCommand(installScriptPath, i.scriptSHA256), joinWords(versionEnv, env, "sh", installScriptPath)), nil
+}
+
+// scriptMismatch is printed by verifyScriptCommand
+const scriptMismatch = "does not match --install-script-sha256"
+
+// installFailed is commandFailed for the command returned by command,
+// saying when the install script was not run because its checksum did
+// not match
+func installFailed(err error, res operator.CommandRes, message string) error {
+	if strings.Contains(string(res.StdErr)+string(res.StdOut), scriptMismatch) {
+		message = "the install script " + scriptMismatch + ", so it was not run"
+	}
+	return commandFailed(err, res, message)
+}
+
+// verifyScriptCommand fails, printing both checksums, when the script at
+// path does not match sum. It is empty when there is no sum to check.
+func verifyScriptCommand(path, sum string) string {
+	if len(sum) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(`{ echo %s | sha256sum -c --status - || { echo "The install script %s %s, want %s, got $(sha256sum %s | cut -d' ' -f1)" >&2; exit 1; }; }`,
+		operator.ShellQuote(sum+"  "+path), path, scriptMismatch, sum, path)
+}
+
+// airgapCommand uploads the artifacts for the architecture of the node
+// and returns the command which installs from them
+func (i rke2Installer) airgapCommand(ctx context.Context, sshOperator operator.Operator, out io.Writer, env string) (string, error) {
+	res, err := sshOperator.ExecuteStdioContext(ctx, "uname -m", false)
+	if err != nil {
+		return "", commandFailed(err, res, "unable to find the architecture of the node")
+	}
+	machine := strings.TrimSpace(string(res.StdOut))
+	if _, dryRun := sshOperator.(*operator.DryRunOperator); dryRun && len(machine) == 0 {
+		machine = "x86_64"
+	}
+	if len(machine) == 0 {
+		return "", fmt.Errorf("unable to find the architecture of the node, uname -m printed nothing")
+	}
+	arch, err := rke2Arch(machine)
+	if err != nil {
+		return "", err
+	}
+
+	artifacts, err := airgapArtifacts(i.airgapDir, arch)
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range artifacts {
+		mode := os.FileMode(0644)
+		if name == "install.sh" {
+			mode = 0755
+		}
+		if err := uploadFile(sshOperator, out, filepath.Join(i.airgapDir, name), path.Join(airgapArtifactsPath, name), mode); err != nil {
+			return "", err
+		}
+	}
+
+	script := path.Join(airgapArtifactsPath, "install.sh")
+	install := joinWords("INSTALL_RKE2_ARTIFACT_PATH="+operator.ShellQuote(airgapArtifactsPath), i.method.env(), env, "sh", operator.ShellQuote(script))
+	return andCommands(verifyScriptCommand(script, i.scriptSHA256), install), nil
+}
+
+// uploadFile copies source to target on the node, printing its size as
+// large files such as image tarballs take a while
+func uploadFile(sshOperator operator.Operator, out io.Writer, source, target string, mode os.FileMode) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open %q", source)
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil {
+		fmt.Fprintf(out, "Uploading %s (%.1f MB)\n", filepath.Base(source), float64(info.Size())/(1<<20))
+	}
+
+	if err := sshOperator.Upload(f, target, mode, ""); err != nil {
+		return explainBecome(err)
+	}
+	return nil
+}
+
+// rke2Arch maps the output of uname -m to the architecture in the names
+// of RKE2 release artifacts
+func rke2Arch(machine string) (string, error) {
+	switch machine {
+	case "x86_64", "amd64":
+		return "amd64", nil
+	case "aarch64", "arm64":
+		return "arm64", nil
+	case "s390x":
+		return "s390x", nil
+	}
+	return "", fmt.Errorf("RKE2 has no release for the architecture of the node: %s", machine)
+}
+
+// airgapArtifacts returns the files in dir to upload for arch, which are
+// install.sh, the rke2 tarball and its sha256sum file, and any image
+// tarballs. Artifacts for other architectures are left out.
+func airgapArtifacts(dir, arch string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read --airgap-dir")
+	}
+
+	required := map[string]bool{
+		"install.sh":                     false,
+		"rke2.linux-" + arch + ".tar.gz": false,
+		"sha256sum-" + arch + ".txt":     false,
+	}
+
+	artifacts := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		if _, ok := required[name]; ok {
+			required[name] = true
+		} else if !strings.HasPrefix(name, "rke2-images") || !strings.Contains(name, ".linux-"+arch+".tar") {
+			continue
+		}
+		artifacts = append(artifacts, name)
+	}
+
+	missing := []string{}
+	for name, found := range required {
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("--airgap-dir %s is missing %s", dir, strings.Join(missing, ", "))
+	}
+
+	return artifacts, nil
+}
+
+// andCommands joins the non-empty commands with &&, so that each only
+// runs when the previous one succeeded
+func andCommands(commands ...string) string {
+	nonEmpty := []string{}
+	for _, command := range commands {
+		if len(command) > 0 {
+			nonEmpty = append(nonEmpty, command)
+		}
+	}
+	return strings.Join(nonEmpty, " && ")
+}
+
+// joinWords joins the non-empty words with spaces
+func joinWords(words ...string) string {
+	nonEmpty := []string{}
+	for _, word := range words {
+		if len(word) > 0 {
+			nonEmpty = append(nonEmpty, word)
+		}
+	}
+	return strings.Join(nonEmpty, " ")
+}
@@ -0,0 +1,253 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+)
+
+const testScriptSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func Test_rke2Installer_command_PipesScript(t *testing.T) {
+	installer := rke2Installer{channel: "stable", scriptURL: "https://mirror.example.com/rke2/install.sh"}
+
+	got, err := installer.command(context.Background(), operator.NewDryRunOperator("node0"), ioutil.Discard, "INSTALL_RKE2_TYPE='server'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "curl -sfL 'https://mirror.example.com/rke2/install.sh' | INSTALL_RKE2_CHANNEL='stable' INSTALL_RKE2_TYPE='server' sh -s -"
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func Test_rke2Installer_command_VerifiesDownload(t *testing.T) {
+	installer := rke2Installer{channel: "stable", scriptURL: defaultInstallScriptURL, scriptSHA256: testScriptSHA256}
+
+	got, err := installer.command(context.Background(), operator.NewDryRunOperator("node0"), ioutil.Discard, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"trap 'rm -f " + installScriptPath + "' EXIT; curl -sfL 'https://get.rke2.io' -o " + installScriptPath + " && ",
+		"echo '" + testScriptSHA256 + "  " + installScriptPath + "' | sha256sum -c --status -",
+		"exit 1; }; } && INSTALL_RKE2_CHANNEL='stable' sh " + installScriptPath,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want %q in %q", want, got)
+		}
+	}
+}
+
+func Test_rke2Installer_command_UploadsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "k2sup-install")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("#!/bin/sh\necho install\n")
+	f.Close()
+
+	op := operator.NewDryRunOperator("node0")
+	op.Out = &bytes.Buffer{}
+	installer := rke2Installer{version: "v1.24.4+rke2r1", scriptFile: f.Name()}
+
+	got, err := installer.command(context.Background(), op, ioutil.Discard, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "trap 'rm -f " + installScriptPath + "' EXIT; INSTALL_RKE2_VERSION='v1.24.4+rke2r1' sh " + installScriptPath; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if len(op.Records) != 1 || op.Records[0].Target != installScriptPath || op.Records[0].Mode != 0700 {
+		t.Errorf("want the script uploaded to %s, got %+v", installScriptPath, op.Records)
+	}
+}
+
+func Test_installFailed_ChecksumMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-install")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "install.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := operator.ExecOperator{}.ExecuteStdio(andCommands(verifyScriptCommand(script, testScriptSHA256), "sh "+script), false)
+	if err == nil {
+		t.Fatal("want the install to fail for a script which does not match")
+	}
+	got := installFailed(err, res, "unable to setup agent").Error()
+	if !strings.HasPrefix(got, "the install script does not match --install-script-sha256, so it was not run") {
+		t.Errorf("want the checksum named as the cause, got %q", got)
+	}
+
+	res = operator.CommandRes{StdErr: []byte("curl: (22) The requested URL returned error: 404\n"), ExitCode: 22}
+	got = installFailed(errors.New("Process exited with status 22"), res, "unable to setup agent").Error()
+	if !strings.HasPrefix(got, "unable to setup agent") {
+		t.Errorf("want other failures left alone, got %q", got)
+	}
+}
+
+func Test_createVersionStr_InstallMethod(t *testing.T) {
+	method := installMethod{method: installMethodRPM, rpmRepoURL: "https://mirror.example.com/rancher/"}
+	got := createVersionStr("", "stable", method)
+	want := "INSTALL_RKE2_CHANNEL='stable' INSTALL_RKE2_METHOD='rpm' INSTALL_RKE2_RPM_SITE='mirror.example.com/rancher'"
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	method = installMethod{method: installMethodAuto, tarPrefix: "/opt/rke2"}
+	got = createVersionStr("v1.24.4+rke2r1", "", method)
+	want = "INSTALL_RKE2_VERSION='v1.24.4+rke2r1' INSTALL_RKE2_TAR_PREFIX='/opt/rke2'"
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func Test_installMethod_validate(t *testing.T) {
+	valid := []installMethod{
+		{},
+		{method: installMethodAuto, tarPrefix: "/opt/rke2", rpmRepoURL: "https://mirror.example.com"},
+		{method: installMethodTar, tarPrefix: "/opt/rke2"},
+		{method: installMethodRPM, rpmRepoURL: "https://mirror.example.com"},
+	}
+	for _, method := range valid {
+		if err := method.validate(false); err != nil {
+			t.Errorf("%+v: want no error, got %s", method, err)
+		}
+	}
+
+	invalid := []installMethod{
+		{method: "deb"},
+		{method: installMethodRPM, tarPrefix: "/opt/rke2"},
+		{method: installMethodTar, rpmRepoURL: "https://mirror.example.com"},
+		{tarPrefix: "opt/rke2"},
+		{rpmRepoURL: "mirror.example.com"},
+	}
+	for _, method := range invalid {
+		if err := method.validate(false); err == nil {
+			t.Errorf("%+v: want an error", method)
+		}
+	}
+
+	if err := (installMethod{method: installMethodRPM}).validate(true); err == nil {
+		t.Errorf("want an error for an air-gapped rpm install")
+	}
+}
+
+func Test_parseSHA256(t *testing.T) {
+	got, err := parseSHA256(" " + strings.ToUpper(testScriptSHA256) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != testScriptSHA256 {
+		t.Errorf("want %s, got %s", testScriptSHA256, got)
+	}
+
+	for _, sum := range []string{"", "abc", testScriptSHA256 + "00", strings.Replace(testScriptSHA256, "e", "g", 1)} {
+		if _, err := parseSHA256(sum); err == nil {
+			t.Errorf("%q: want an error", sum)
+		}
+	}
+}
+
+func Test_airgapArtifacts_SelectsArch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-airgap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"install.sh",
+		"rke2.linux-amd64.tar.gz",
+		"rke2.linux-arm64.tar.gz",
+		"sha256sum-amd64.txt",
+		"sha256sum-arm64.txt",
+		"rke2-images.linux-amd64.tar.zst",
+		"rke2-images-canal.linux-amd64.tar.gz",
+		"rke2-images.linux-arm64.tar.zst",
+		"README.md",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := airgapArtifacts(dir, "arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"install.sh", "rke2-images.linux-arm64.tar.zst", "rke2.linux-arm64.tar.gz", "sha256sum-arm64.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if _, err := airgapArtifacts(dir, "s390x"); err == nil {
+		t.Errorf("want an error when the tarball for the architecture is missing")
+	}
+}
+
+// silentOperator runs nothing and prints nothing, but is not a dry run
+type silentOperator struct {
+	*operator.DryRunOperator
+}
+
+func Test_rke2Installer_airgapCommand_NoArch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-airgap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"install.sh", "rke2.linux-amd64.tar.gz", "sha256sum-amd64.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	installer := rke2Installer{airgapDir: dir}
+
+	dryRun := operator.NewDryRunOperator("node0")
+	dryRun.Out = &bytes.Buffer{}
+	if _, err := installer.airgapCommand(context.Background(), dryRun, ioutil.Discard, ""); err != nil {
+		t.Errorf("want a dry run to assume x86_64, got %s", err)
+	}
+
+	silent := silentOperator{operator.NewDryRunOperator("node0")}
+	silent.Out = &bytes.Buffer{}
+	if _, err := installer.airgapCommand(context.Background(), silent, ioutil.Discard, ""); err == nil {
+		t.Errorf("want an error when uname -m prints nothing")
+	}
+	for _, record := range silent.Records {
+		if len(record.Target) > 0 {
+			t.Errorf("want nothing uploaded without the architecture, got %s", record.Target)
+		}
+	}
+}
+
+func Test_rke2Arch(t *testing.T) {
+	for machine, want := range map[string]string{"x86_64": "amd64", "aarch64": "arm64", "arm64": "arm64", "s390x": "s390x"} {
+		got, err := rke2Arch(machine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: want %s, got %s", machine, want, got)
+		}
+	}
+
+	if _, err := rke2Arch("armv7l"); err == nil {
+		t.Errorf("want an error for an architecture without an RKE2 release")
+	}
+}
@@ -1,16 +1,17 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
-	"runtime"
 	"strings"
+	"time"
 
 	operator "github.com/alexellis/k3sup/pkg/operator"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
-	"golang.org/x/crypto/ssh"
 )
 
 // SupportMsg is aimed to inform the many hundreds of users of k3sup
@@ -37,43 +38,80 @@ func MakeJoin() *cobra.Command {
 		SilenceUsage: true,
 	}
 
-	command.Flags().IP("ip", net.ParseIP("127.0.0.1"), "Public IP of node on which to install agent")
+	command.Flags().IPSlice("ip", []net.IP{net.ParseIP("127.0.0.1")}, "Public IP of node on which to install agent, repeat the flag to join several nodes")
 	command.Flags().IP("server-ip", net.ParseIP("127.0.0.1"), "Public IP of an existing RKE2 server")
 
-	command.Flags().String("host", "", "Public hostname of node on which to install agent")
+	command.Flags().StringArray("host", []string{}, "Public hostname of node on which to install agent, repeat the flag to join several nodes")
+	command.Flags().String("hosts-file", "", "A file listing the hostnames of nodes to join, one per line")
+	command.Flags().Int("parallel", 1, "Number of agents to join at the same time, servers are always joined one at a time")
 	command.Flags().String("server-host", "", "Public hostname of an existing RKE2 server")
+	command.Flags().String("token", "", "The server token to join with, instead of reading it from the server over SSH, or set K2SUP_TOKEN")
+	command.Flags().String("token-file", "", "A file holding the server token to join with")
+	command.Flags().String("agent-token", "", "The agent-token which agents join with, instead of the server token, or set K2SUP_AGENT_TOKEN")
+	command.Flags().String("agent-token-file", "", "A file holding the agent-token which agents join with")
 
 	command.Flags().String("user", "root", "Username for SSH login")
 	command.Flags().String("server-user", "root", "Server username for SSH login (Default to --user)")
 
-	command.Flags().String("ssh-key", "~/.ssh/id_rsa", "The ssh key to use for remote login")
 	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
 	command.Flags().Int("server-ssh-port", 22, "The port on which to connect to server for ssh (Default to --ssh-port)")
+
+	addConnectionFlags(command)
+
 	command.Flags().Bool("skip-install", false, "Skip the RKE2 installer")
-	command.Flags().Bool("sudo", true, "Use sudo for installation. e.g. set to false when using the root user and no sudo is available.")
 
+	command.Flags().Bool("local", false, "Install on this machine rather than over SSH, the server is still reached over SSH to get the join token")
 	command.Flags().Bool("server", false, "Join the cluster as a server rather than as an agent for the embedded etcd mode")
-	command.Flags().Bool("print-command", false, "Print a command that you can use with SSH to manually recover from an error")
+	command.Flags().Bool("wait", false, "Wait for each node to become Ready and its kube-system pods to run before reporting success")
+	command.Flags().Duration("wait-timeout", 10*time.Minute, "How long --wait waits for each node before failing with what it is blocked on")
 
 	command.Flags().String("version", "", "Set a version to install, overrides --channel")
 	command.Flags().String("channel", PinnedChannel, "Release channel: stable, latest, or i.e. v1.19")
 	command.Flags().String("config", "", "RKE2 configuration file to use")
 	command.Flags().String("registries", "", "containerd registry configuration file to use")
+	command.Flags().String("install-script-url", defaultInstallScriptURL, "Download the RKE2 install script from this URL on the node, such as an internal mirror")
+	command.Flags().String("install-script-file", "", "Upload this copy of the RKE2 install script rather than downloading it on the node")
+	command.Flags().String("install-script-sha256", "", "The SHA-256 checksum of the install script, which is verified on the node before it is run")
+	command.Flags().String("install-method", installMethodAuto, "How the install script installs RKE2: auto, tar or rpm (auto uses rpm on RHEL-family hosts)")
+	command.Flags().String("install-tar-prefix", "", "Where a tar install puts RKE2, e.g. /opt/rke2 when /usr/local is read-only (Default /usr/local)")
+	command.Flags().String("rpm-repo-url", "", "An https:// mirror of rpm.rancher.io used by the rpm install method")
+	command.Flags().String("airgap-dir", "", "Install without internet access from a directory holding install.sh, the rke2 tarball, its sha256sum file and image tarballs, which are uploaded for the architecture of each node")
 
 	command.RunE = func(command *cobra.Command, args []string) error {
 		fmt.Printf("Running: k2sup join\n")
 
-		ip, err := command.Flags().GetIP("ip")
+		ips, err := command.Flags().GetIPSlice("ip")
 		if err != nil {
 			return err
 		}
 
-		host, err := command.Flags().GetString("host")
+		hosts, err := command.Flags().GetStringArray("host")
+		if err != nil {
+			return err
+		}
+		hostsFile, err := command.Flags().GetString("hosts-file")
 		if err != nil {
 			return err
 		}
-		if len(host) == 0 {
-			host = ip.String()
+		if len(hostsFile) > 0 {
+			fileHosts, err := readHostsFile(expandPath(hostsFile))
+			if err != nil {
+				return err
+			}
+			hosts = append(hosts, fileHosts...)
+		}
+		if len(hosts) == 0 {
+			for _, ip := range ips {
+				hosts = append(hosts, ip.String())
+			}
+		}
+
+		parallel, err := command.Flags().GetInt("parallel")
+		if err != nil {
+			return err
+		}
+		if parallel < 1 {
+			return fmt.Errorf("--parallel must be at least 1")
 		}
 
 		serverIP, err := command.Flags().GetIP("server-ip")
@@ -89,32 +127,55 @@ func MakeJoin() *cobra.Command {
 			serverHost = serverIP.String()
 		}
 
+		openSSHConfig, err := loadSSHConfig(command)
+		if err != nil {
+			return err
+		}
+
+		serverTarget, err := resolveSSHTarget(command, openSSHConfig, serverHost, []string{"server-user", "user"}, []string{"server-ssh-port", "ssh-port"})
+		if err != nil {
+			return err
+		}
+		serverHost = serverTarget.Host
+
 		fmt.Println("Server IP: " + serverHost)
 
-		user, _ := command.Flags().GetString("user")
+		local, err := command.Flags().GetBool("local")
+		if err != nil {
+			return err
+		}
 
-		serverUser := user
-		if command.Flags().Changed("server-user") {
-			serverUser, _ = command.Flags().GetString("server-user")
+		nodeTargets := []operator.Target{{}}
+		if local && len(hosts) > 1 {
+			return fmt.Errorf("only one node can be joined with --local")
+		}
+		if !local {
+			nodeTargets = make([]operator.Target, len(hosts))
+			for i, host := range hosts {
+				nodeTargets[i], err = resolveSSHTarget(command, openSSHConfig, host, []string{"user"}, []string{"ssh-port"})
+				if err != nil {
+					return err
+				}
+			}
 		}
 
-		sshKey, _ := command.Flags().GetString("ssh-key")
 		server, err := command.Flags().GetBool("server")
 		if err != nil {
 			return err
 		}
-
-		port, _ := command.Flags().GetInt("ssh-port")
-		serverPort := port
-		if command.Flags().Changed("server-ssh-port") {
-			serverPort, _ = command.Flags().GetInt("server-ssh-port")
+		if server && parallel > 1 {
+			return fmt.Errorf("servers must join one at a time, remove --parallel")
 		}
 
-		rke2Version, err := command.Flags().GetString("version")
+		tokens, err := makeJoinTokens(command)
 		if err != nil {
 			return err
 		}
-		rke2Channel, err := command.Flags().GetString("channel")
+		if server && len(tokens.agent) > 0 && len(tokens.server) == 0 {
+			return fmt.Errorf("servers join with the server token, give --token as well as --agent-token")
+		}
+
+		installer, err := makeInstaller(command)
 		if err != nil {
 			return err
 		}
@@ -129,113 +190,138 @@ func MakeJoin() *cobra.Command {
 			return err
 		}
 
-		if len(rke2Version) == 0 && len(rke2Channel) == 0 {
-			return fmt.Errorf("give a value for --version or --channel")
+		printCommand, err := command.Flags().GetBool("print-command")
+		if err != nil {
+			return err
+		}
+		timeout, err := command.Flags().GetDuration("timeout")
+		if err != nil {
+			return err
+		}
+		waitTimeout, err := makeWaitTimeout(command)
+		if err != nil {
+			return err
+		}
+		if waitTimeout > 0 && tokens.given() {
+			return fmt.Errorf("--wait checks on the node from the server over SSH, it cannot be used when the token is given")
 		}
 
-		printCommand, err := command.Flags().GetBool("print-command")
+		passwords, err := readPasswords(command)
+		if err != nil {
+			return err
+		}
+		become, err := makeBecomeOptions(command, passwords.sudo)
 		if err != nil {
 			return err
 		}
 
-		useSudo, err := command.Flags().GetBool("sudo")
+		dryRun, err := command.Flags().GetBool("dry-run")
 		if err != nil {
 			return err
 		}
-		sudoPrefix := ""
-		if useSudo {
-			sudoPrefix = "sudo "
+		audit, err := makeAuditOptions(command, serverHost)
+		if err != nil {
+			return err
+		}
+		options := operatorOptions{
+			local:  local,
+			dryRun: dryRun,
+			become: become,
+			audit:  audit,
 		}
 
-		sshKeyPath := expandPath(sshKey)
-		address := fmt.Sprintf("%s:%d", serverHost, serverPort)
+		ctx := command.Context()
 
-		var sshOperator *operator.SSHOperator
-		var initialSSHErr error
-		if runtime.GOOS != "windows" {
+		var connector *operator.Connector
+		if !dryRun {
+			connector, err = makeConnector(command, passwords.ssh)
+			if err != nil {
+				return err
+			}
+			defer connector.Close()
+		}
 
-			var sshAgentAuthMethod ssh.AuthMethod
-			sshAgentAuthMethod, initialSSHErr = sshAgentOnly()
-			if initialSSHErr == nil {
-				// Try SSH agent without parsing key files, will succeed if the user
-				// has already added a key to the SSH Agent, or if using a configured
-				// smartcard
-				config := &ssh.ClientConfig{
-					User:            serverUser,
-					Auth:            []ssh.AuthMethod{sshAgentAuthMethod},
-					HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		// Agents join with the agent-token when the server has one, so
+		// that they never hold the server token
+		tokenCommand := getAgentTokenCommand
+		if server {
+			tokenCommand = getTokenCommand
+		}
+
+		waiter := nodeWaiter{timeout: waitTimeout, dryRun: dryRun}
+		joinToken := tokens.forNode(server)
+		if len(joinToken) > 0 {
+			fmt.Printf("Joining with the token given, %s is not connected to\n", serverHost)
+		} else if dryRun {
+			joinToken = dryRunJoinToken
+			fmt.Printf("Dry run: the join token would be read from %s\n", serverHost)
+			if waitTimeout > 0 {
+				if waiter.server, err = openOperator(ctx, nil, serverTarget, operatorOptions{dryRun: true, become: become}); err != nil {
+					return err
 				}
-
-				sshOperator, initialSSHErr = operator.NewSSHOperator(address, config)
 			}
 		} else {
-			initialSSHErr = errors.New("ssh-agent unsupported on windows")
-		}
-
-		// If the initial connection attempt fails fall through to the using
-		// the supplied/default private key file
-		var publicKeyFileAuth ssh.AuthMethod
-		var closeSSHAgent func() error
-		if initialSSHErr != nil {
-			var err error
-			publicKeyFileAuth, closeSSHAgent, err = loadPublickey(sshKeyPath)
+			sshOperator, err := openOperator(ctx, connector, serverTarget, operatorOptions{
+				become: become,
+				audit:  audit,
+			})
 			if err != nil {
-				return errors.Wrapf(err, "unable to load the ssh key with path %q", sshKeyPath)
+				return errors.Wrap(err, "unable to connect to the server")
 			}
 
-			defer closeSSHAgent()
-
-			config := &ssh.ClientConfig{
-				User: serverUser,
-				Auth: []ssh.AuthMethod{
-					publicKeyFileAuth,
-				},
-				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			if printCommand {
+				fmt.Printf("ssh: %s\n", tokenCommand)
 			}
 
-			sshOperator, err = operator.NewSSHOperator(address, config)
+			res, err := executeSecret(ctx, sshOperator, timeout, tokenCommand)
+			// The server is kept open to check on the nodes with --wait
+			if waitTimeout > 0 {
+				defer sshOperator.Close()
+				waiter.server = sshOperator
+			} else {
+				sshOperator.Close()
+			}
 
 			if err != nil {
-				return errors.Wrapf(err, "unable to connect to (server) %s over ssh", address)
+				return commandFailed(err, res, "unable to get join-token from server")
 			}
-		}
 
-		defer sshOperator.Close()
-
-		getTokenCommand := fmt.Sprintf(sudoPrefix + "cat /var/lib/rancher/rke2/server/node-token\n")
-		if printCommand {
-			fmt.Printf("ssh: %s\n", getTokenCommand)
-		}
-
-		res, err := sshOperator.Execute(getTokenCommand)
-
-		if err != nil {
-			return errors.Wrap(err, "unable to get join-token from server")
-		}
+			if len(res.StdErr) > 0 {
+				fmt.Printf("Logs: %s", res.StdErr)
+			}
 
-		if len(res.StdErr) > 0 {
-			fmt.Printf("Logs: %s", res.StdErr)
+			joinToken = string(res.StdOut)
 		}
+		options.audit.secrets = append(options.audit.secrets, joinToken, tokens.agent)
 
-		if closeSSHAgent != nil {
-			closeSSHAgent()
+		setup := func(nodeOperator operator.Operator, out io.Writer) error {
+			var err error
+			if server {
+				err = setupAdditionalServer(ctx, nodeOperator, out, installer, serverHost, joinToken, tokens.agent, configFile, registriesFile, printCommand, timeout)
+			} else {
+				err = setupAgent(ctx, nodeOperator, out, installer, serverHost, joinToken, configFile, registriesFile, printCommand, timeout)
+			}
+			if err != nil || waitTimeout == 0 {
+				return err
+			}
+			return waiter.wait(ctx, nodeOperator, out, configFile)
 		}
-		sshOperator.Close()
 
-		joinToken := string(res.StdOut)
+		if len(nodeTargets) == 1 {
+			nodeOperator, err := openOperator(ctx, connector, nodeTargets[0], options)
+			if err != nil {
+				return err
+			}
+			defer nodeOperator.Close()
 
-		var boostrapErr error
-		if server {
-			boostrapErr = setupAdditionalServer(serverHost, host, port, user, sshKeyPath, joinToken, rke2Version, rke2Channel, configFile, registriesFile, sudoPrefix, printCommand)
-		} else {
-			boostrapErr = setupAgent(serverHost, host, port, user, sshKeyPath, joinToken, rke2Version, rke2Channel, configFile, registriesFile, sudoPrefix, printCommand)
+			return setup(nodeOperator, os.Stdout)
 		}
 
-		return boostrapErr
+		return joinNodes(ctx, connector, nodeTargets, options, parallel, setup)
 	}
 
 	command.PreRunE = func(command *cobra.Command, args []string) error {
-		_, err := command.Flags().GetIP("ip")
+		_, err := command.Flags().GetIPSlice("ip")
 		if err != nil {
 			return err
 		}
@@ -243,7 +329,7 @@ func MakeJoin() *cobra.Command {
 		if err != nil {
 			return err
 		}
-		_, err = command.Flags().GetString("host")
+		_, err = command.Flags().GetStringArray("host")
 		if err != nil {
 			return err
 		}
@@ -261,71 +347,24 @@ func MakeJoin() *cobra.Command {
 	return command
 }
 
-func setupAdditionalServer(serverHost, host string, port int, user, sshKeyPath, joinToken, rke2Version, rke2Channel, configFile, registriesFile, sudoPrefix string, printCommand bool) error {
-	address := fmt.Sprintf("%s:%d", host, port)
-
-	var sshOperator *operator.SSHOperator
-	var initialSSHErr error
-	if runtime.GOOS != "windows" {
-
-		var sshAgentAuthMethod ssh.AuthMethod
-		sshAgentAuthMethod, initialSSHErr = sshAgentOnly()
-		if initialSSHErr == nil {
-			// Try SSH agent without parsing key files, will succeed if the user
-			// has already added a key to the SSH Agent, or if using a configured
-			// smartcard
-			config := &ssh.ClientConfig{
-				User:            user,
-				Auth:            []ssh.AuthMethod{sshAgentAuthMethod},
-				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			}
-
-			sshOperator, initialSSHErr = operator.NewSSHOperator(address, config)
-		}
-	} else {
-		initialSSHErr = errors.New("ssh-agent unsupported on windows")
-	}
-
-	// If the initial connection attempt fails fall through to the using
-	// the supplied/default private key file
-	if initialSSHErr != nil {
-		publicKeyFileAuth, closeSSHAgent, err := loadPublickey(sshKeyPath)
-		if err != nil {
-			return errors.Wrapf(err, "unable to load the ssh key with path %q", sshKeyPath)
-		}
-
-		defer closeSSHAgent()
-
-		config := &ssh.ClientConfig{
-			User: user,
-			Auth: []ssh.AuthMethod{
-				publicKeyFileAuth,
-			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		}
+// setupAdditionalServer joins a server to the cluster, agentToken is
+// written to its config when the cluster has a separate agent-token
+func setupAdditionalServer(ctx context.Context, sshOperator operator.Operator, out io.Writer, installer rke2Installer, serverHost, joinToken, agentToken, configFile, registriesFile string, printCommand bool, timeout time.Duration) error {
+	fmt.Fprintln(out, createVersionStr(installer.version, installer.channel, installer.method))
 
-		sshOperator, err = operator.NewSSHOperator(address, config)
-
-		if err != nil {
-			return errors.Wrapf(err, "unable to connect to %s over ssh as %s", address, user)
-		}
+	if err := makeConfigDir(sshOperator); err != nil {
+		return err
 	}
 
-	installStr := createVersionStr(rke2Version, rke2Channel)
-
-	fmt.Println(installStr)
-
-	defer sshOperator.Close()
-
-	sshOperator.Execute(fmt.Sprintf("%s mkdir -p "+rke2ConfigPath, sudoPrefix))
-
 	if configFile != "" {
 		f, err := os.Open(configFile)
 		if err != nil {
 			return errors.Wrapf(err, "unable to open specified config file %q", configFile)
 		}
 		defer f.Close()
-		sshOperator.CopySCP(f, rke2ConfigFile)
+		if err := sshOperator.Upload(f, rke2ConfigFile, 0600, ""); err != nil {
+			return explainBecome(err)
+		}
 	}
 
 	if registriesFile != "" {
@@ -334,109 +373,61 @@ func setupAdditionalServer(serverHost, host string, port int, user, sshKeyPath,
 			return errors.Wrapf(err, "unable to open specified config file %q", registriesFile)
 		}
 		defer f.Close()
-		sshOperator.CopySCP(f, containerdRegistriesFile)
+		if err := sshOperator.Upload(f, containerdRegistriesFile, 0600, ""); err != nil {
+			return explainBecome(err)
+		}
 	}
 
-	installRKE2Exec := installStr + " INSTALL_RKE2_TYPE='server' sh -s -"
-
-	rkeConfig := makeConfig(serverHost, strings.TrimSpace(joinToken))
+	installAgentServerCommand, err := installer.command(ctx, sshOperator, out, "INSTALL_RKE2_TYPE='server'")
+	if err != nil {
+		return err
+	}
 
-	populateConfig := fmt.Sprintf("echo '%s' | %s tee -a "+rke2ConfigFile, rkeConfig, sudoPrefix)
-	installAgentServerCommand := fmt.Sprintf("%s | %s %s", getScript, sudoPrefix, installRKE2Exec)
-	ensureSystemdcommand := fmt.Sprintf("%s systemctl enable --no-block --now rke2-server", sudoPrefix)
+	rkeConfig := makeConfig(serverHost, strings.TrimSpace(joinToken), strings.TrimSpace(agentToken))
 
-	if printCommand {
-		fmt.Printf("ssh: %s\n", installAgentServerCommand)
+	if err := uploadJoinConfig(sshOperator, rkeConfig); err != nil {
+		return err
 	}
+	ensureSystemdcommand := "systemctl enable --no-block --now rke2-server"
 
-	_, err := sshOperator.Execute(populateConfig)
-	if err != nil {
-		return err
+	if printCommand {
+		fmt.Fprintf(out, "ssh: %s\n", installAgentServerCommand)
 	}
 
-	res, err := sshOperator.Execute(installAgentServerCommand)
+	res, err := executePhase(ctx, sshOperator, timeout, installAgentServerCommand)
 	if err != nil {
-		return errors.Wrap(err, "unable to setup agent")
+		return installFailed(err, res, "unable to setup agent")
 	}
 
-	fmt.Printf("🐌 Joining server node to cluster, please wait while services start...\n")
-	_, err = sshOperator.Execute(ensureSystemdcommand)
-	if err != nil {
-		return err
+	fmt.Fprintf(out, "🐌 Joining server node to cluster, please wait while services start...\n")
+	if systemdRes, err := executePhase(ctx, sshOperator, timeout, ensureSystemdcommand); err != nil {
+		return commandFailed(err, systemdRes, "unable to start rke2-server")
 	}
 
 	if len(res.StdErr) > 0 {
-		fmt.Printf("Logs: %s", res.StdErr)
+		fmt.Fprintf(out, "Logs: %s", res.StdErr)
 	}
 
 	joinRes := string(res.StdOut)
-	fmt.Printf("Output: %s", string(joinRes))
+	fmt.Fprintf(out, "Output: %s", string(joinRes))
 
 	return nil
 }
 
-func setupAgent(serverHost, host string, port int, user, sshKeyPath, joinToken, rke2Version, rke2Channel, configFile, registriesFile, sudoPrefix string, printCommand bool) error {
-
-	address := fmt.Sprintf("%s:%d", host, port)
-
-	var sshOperator *operator.SSHOperator
-	var initialSSHErr error
-	if runtime.GOOS != "windows" {
-
-		var sshAgentAuthMethod ssh.AuthMethod
-		sshAgentAuthMethod, initialSSHErr = sshAgentOnly()
-		if initialSSHErr == nil {
-			// Try SSH agent without parsing key files, will succeed if the user
-			// has already added a key to the SSH Agent, or if using a configured
-			// smartcard
-			config := &ssh.ClientConfig{
-				User:            user,
-				Auth:            []ssh.AuthMethod{sshAgentAuthMethod},
-				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			}
-
-			sshOperator, initialSSHErr = operator.NewSSHOperator(address, config)
-		}
-	} else {
-		initialSSHErr = errors.New("ssh-agent unsupported on windows")
-	}
-
-	// If the initial connection attempt fails fall through to the using
-	// the supplied/default private key file
-	if initialSSHErr != nil {
-		publicKeyFileAuth, closeSSHAgent, err := loadPublickey(sshKeyPath)
-		if err != nil {
-			return errors.Wrapf(err, "unable to load the ssh key with path %q", sshKeyPath)
-		}
-
-		defer closeSSHAgent()
-
-		config := &ssh.ClientConfig{
-			User: user,
-			Auth: []ssh.AuthMethod{
-				publicKeyFileAuth,
-			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		}
-
-		sshOperator, err = operator.NewSSHOperator(address, config)
-
-		if err != nil {
-			return errors.Wrapf(err, "unable to connect to %s over ssh", address)
-		}
+func setupAgent(ctx context.Context, sshOperator operator.Operator, out io.Writer, installer rke2Installer, serverHost, joinToken, configFile, registriesFile string, printCommand bool, timeout time.Duration) error {
+	if err := makeConfigDir(sshOperator); err != nil {
+		return err
 	}
 
-	defer sshOperator.Close()
-
-	sshOperator.Execute(fmt.Sprintf("%s mkdir -p " + rke2ConfigPath, sudoPrefix))
-
 	if configFile != "" {
 		f, err := os.Open(configFile)
 		if err != nil {
 			return errors.Wrapf(err, "unable to open specified config file %q", configFile)
 		}
 		defer f.Close()
-		sshOperator.CopySCP(f, rke2ConfigFile)
+		if err := sshOperator.Upload(f, rke2ConfigFile, 0600, ""); err != nil {
+			return explainBecome(err)
+		}
 	}
 
 	if registriesFile != "" {
@@ -445,60 +436,82 @@ func setupAgent(serverHost, host string, port int, user, sshKeyPath, joinToken,
 			return errors.Wrapf(err, "unable to open specified config file %q", registriesFile)
 		}
 		defer f.Close()
-		sshOperator.CopySCP(f, containerdRegistriesFile)
+		if err := sshOperator.Upload(f, containerdRegistriesFile, 0600, ""); err != nil {
+			return explainBecome(err)
+		}
 	}
 
-	installStr := createVersionStr(rke2Version, rke2Channel)
-	installRKE2Exec := installStr + " sh -s -"
-
-	rkeConfig := makeConfig(serverHost, strings.TrimSpace(joinToken))
-
-	populateConfig := fmt.Sprintf("echo '%s' | %s tee -a "+rke2ConfigFile, rkeConfig, sudoPrefix)
-	ensureSystemdcommand := fmt.Sprintf("%s systemctl enable --no-block --now rke2-agent", sudoPrefix)
+	installAgentCommand, err := installer.command(ctx, sshOperator, out, "")
+	if err != nil {
+		return err
+	}
 
-	installAgentCommand := fmt.Sprintf("%s | %s %s", getScript, sudoPrefix, installRKE2Exec)
+	rkeConfig := makeConfig(serverHost, strings.TrimSpace(joinToken), "")
 
-	if printCommand {
-		fmt.Printf("ssh: %s\n", installAgentCommand)
+	if err := uploadJoinConfig(sshOperator, rkeConfig); err != nil {
+		return err
 	}
+	ensureSystemdcommand := "systemctl enable --no-block --now rke2-agent"
 
-	_, err := sshOperator.Execute(populateConfig)
-	if err != nil {
-		return err
+	if printCommand {
+		fmt.Fprintf(out, "ssh: %s\n", installAgentCommand)
 	}
 
-	res, err := sshOperator.Execute(installAgentCommand)
+	res, err := executePhase(ctx, sshOperator, timeout, installAgentCommand)
 
 	if err != nil {
-		return errors.Wrap(err, "unable to setup agent")
+		return installFailed(err, res, "unable to setup agent")
 	}
 
-	fmt.Printf("🐌 Joining agent node to cluster, please be patient while services start...\n")
-	_, err = sshOperator.Execute(ensureSystemdcommand)
-	if err != nil {
-		return err
+	fmt.Fprintf(out, "🐌 Joining agent node to cluster, please be patient while services start...\n")
+	if systemdRes, err := executePhase(ctx, sshOperator, timeout, ensureSystemdcommand); err != nil {
+		return commandFailed(err, systemdRes, "unable to start rke2-agent")
 	}
 
 	if len(res.StdErr) > 0 {
-		fmt.Printf("Logs: %s", res.StdErr)
+		fmt.Fprintf(out, "Logs: %s", res.StdErr)
 	}
 
 	joinRes := string(res.StdOut)
-	fmt.Printf("Output: %s", string(joinRes))
+	fmt.Fprintf(out, "Output: %s", string(joinRes))
 
 	return nil
 }
 
-func createVersionStr(rke2Version, Channel string) string {
+// getTokenCommand prints the token which nodes use to join the cluster
+const getTokenCommand = "cat /var/lib/rancher/rke2/server/node-token\n"
+
+// dryRunJoinToken stands in for the token read from the server, which is
+// not connected to in a dry run
+const dryRunJoinToken = "<join-token>"
+
+func createVersionStr(rke2Version, Channel string, method installMethod) string {
 	installStr := ""
 	if len(rke2Version) > 0 {
 		installStr = fmt.Sprintf("INSTALL_RKE2_VERSION='%s'", rke2Version)
 	} else {
 		installStr = fmt.Sprintf("INSTALL_RKE2_CHANNEL='%s'", Channel)
 	}
-	return installStr
+	return joinWords(installStr, method.env())
 }
 
-func makeConfig(server, token string) string {
-	return fmt.Sprintf("server: https://%s:9345 \ntoken: %s\n", server, token)
+// rke2JoinConfigFile holds the server and token a node joins with. It
+// is replaced on every join, and RKE2 merges it with config.yaml.
+const rke2JoinConfigFile = rke2ConfigPath + "config.yaml.d/10-k2sup-join.yaml"
+
+// uploadJoinConfig writes config to rke2JoinConfigFile, readable only by
+// root as it holds the join token
+func uploadJoinConfig(sshOperator operator.Uploader, config string) error {
+	if err := sshOperator.Upload(strings.NewReader(config), rke2JoinConfigFile, 0600, ""); err != nil {
+		return explainBecome(err)
+	}
+	return nil
+}
+
+func makeConfig(server, token, agentToken string) string {
+	config := fmt.Sprintf("server: https://%s:9345 \ntoken: %s\n", server, token)
+	if len(agentToken) > 0 {
+		config += fmt.Sprintf("agent-token: %s\n", agentToken)
+	}
+	return config
 }
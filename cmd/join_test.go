@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+)
+
+func Test_setupAgent_UploadsJoinConfig(t *testing.T) {
+	op := operator.NewDryRunOperator("agent-1")
+	op.Out = ioutil.Discard
+
+	installer := rke2Installer{channel: "stable", scriptURL: defaultInstallScriptURL}
+	if err := setupAgent(context.Background(), op, ioutil.Discard, installer, "192.168.0.10", "K10secret::server:token\n", "", "", false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	uploads := []operator.DryRunRecord{}
+	for _, record := range op.Records {
+		if len(record.Target) > 0 {
+			uploads = append(uploads, record)
+		} else if strings.Contains(record.Command, "K10secret") {
+			t.Errorf("want the token kept off the command line, got %q", record.Command)
+		}
+	}
+
+	if len(uploads) != 1 || uploads[0].Target != rke2JoinConfigFile || uploads[0].Mode != 0600 {
+		t.Fatalf("want the join config uploaded to %s with mode 0600, got %+v", rke2JoinConfigFile, uploads)
+	}
+	want := "server: https://192.168.0.10:9345 \ntoken: K10secret::server:token\n"
+	if got := string(uploads[0].Contents); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/pkg/errors"
+)
+
+// nodeTask names what is done to each node by runNodes, for its output
+type nodeTask struct {
+	verb    string
+	running string
+	done    string
+
+	// stopOnError starts no more nodes once one has failed, the nodes
+	// which already started are left to finish
+	stopOnError bool
+}
+
+var joinTask = nodeTask{verb: "join", running: "Joining", done: "joined"}
+
+// errSkipped is reported for the nodes which were not started after a
+// failure with nodeTask.stopOnError
+var errSkipped = errors.New("skipped after an earlier failure")
+
+// joinNodes runs setup on each of targets, see runNodes
+func joinNodes(ctx context.Context, connector *operator.Connector, targets []operator.Target, options operatorOptions, parallel int, setup func(operator.Operator, io.Writer) error) error {
+	return runNodes(ctx, connector, targets, options, parallel, joinTask, setup)
+}
+
+// runNodes runs run on each of targets, at most parallel at a time.
+// Each line of output is prefixed with the host it came from, and a
+// summary is printed once every node has finished.
+func runNodes(ctx context.Context, connector *operator.Connector, targets []operator.Target, options operatorOptions, parallel int, task nodeTask, run func(operator.Operator, io.Writer) error) error {
+	fmt.Printf("%s %d nodes, %d at a time\n", task.running, len(targets), parallel)
+
+	errs := make([]error, len(targets))
+	slots := make(chan struct{}, parallel)
+	outputMu := &sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	failedMu := sync.Mutex{}
+	anyFailed := false
+	shouldStart := func() bool {
+		failedMu.Lock()
+		defer failedMu.Unlock()
+		return !(task.stopOnError && anyFailed)
+	}
+
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target operator.Target) {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			if !shouldStart() {
+				errs[i] = errSkipped
+				return
+			}
+			defer func() {
+				if errs[i] != nil {
+					failedMu.Lock()
+					anyFailed = true
+					failedMu.Unlock()
+				}
+			}()
+
+			stdout := newPrefixWriter(os.Stdout, outputMu, target.Host)
+			stderr := newPrefixWriter(os.Stderr, outputMu, target.Host)
+			defer stdout.Flush()
+			defer stderr.Flush()
+
+			nodeOptions := options
+			nodeOptions.stdout = stdout
+			nodeOptions.stderr = stderr
+
+			nodeOperator, err := openOperator(ctx, connector, target, nodeOptions)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer nodeOperator.Close()
+
+			errs[i] = run(nodeOperator, stdout)
+		}(i, target)
+	}
+	wg.Wait()
+
+	failed := 0
+	summary := strings.Builder{}
+	for i, target := range targets {
+		status := task.done
+		if errs[i] == errSkipped {
+			failed++
+			status = errSkipped.Error()
+		} else if errs[i] != nil {
+			failed++
+			// Indent the stderr of a failed command under the host
+			status = "failed: " + strings.Replace(errs[i].Error(), "\n", "\n    ", -1)
+		}
+		fmt.Fprintf(&summary, "  %s: %s\n", target.Host, status)
+	}
+	fmt.Printf("\n%s%s %d of %d nodes:\n%s", strings.ToUpper(task.done[:1]), task.done[1:], len(targets)-failed, len(targets), summary.String())
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d nodes failed to %s", failed, len(targets), task.verb)
+	}
+	return nil
+}
+
+// readHostsFile reads one host per line, ignoring blank lines and
+// comments starting with #
+func readHostsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read the hosts file")
+	}
+	defer f.Close()
+
+	hosts := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			hosts = append(hosts, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read the hosts file")
+	}
+
+	return hosts, nil
+}
+
+// prefixWriter writes each line to out with a prefix naming the host it
+// came from. Only whole lines are written, while holding mu, so that the
+// lines of hosts sharing out are never mixed.
+type prefixWriter struct {
+	out    io.Writer
+	mu     *sync.Mutex
+	prefix []byte
+	line   []byte
+}
+
+func newPrefixWriter(out io.Writer, mu *sync.Mutex, host string) *prefixWriter {
+	return &prefixWriter{
+		out:    out,
+		mu:     mu,
+		prefix: []byte("[" + host + "] "),
+	}
+}
+
+func (w *prefixWriter) Write(b []byte) (int, error) {
+	w.line = append(w.line, b...)
+
+	lines := []byte{}
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, w.prefix...)
+		lines = append(lines, w.line[:i+1]...)
+		w.line = w.line[i+1:]
+	}
+
+	if len(lines) > 0 {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, err := w.out.Write(lines); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush writes any final line which did not end with a newline
+func (w *prefixWriter) Flush() error {
+	if len(w.line) == 0 {
+		return nil
+	}
+	_, err := w.Write([]byte("\n"))
+	return err
+}
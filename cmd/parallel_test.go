@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+)
+
+func Test_prefixWriter_WholeLines(t *testing.T) {
+	out := bytes.Buffer{}
+	w := newPrefixWriter(&out, &sync.Mutex{}, "node1")
+
+	for _, chunk := range []string{"Insta", "lling\nStar", "ting\n", "done"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := out.String(); got != "[node1] Installing\n[node1] Starting\n" {
+		t.Errorf("want only whole lines before Flush, got %q", got)
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "[node1] Installing\n[node1] Starting\n[node1] done\n" {
+		t.Errorf("want the last line after Flush, got %q", got)
+	}
+}
+
+func Test_readHostsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	contents := "# agents\nagent0\n\n  agent1  # rack 2\n192.168.0.12\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readHostsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"agent0", "agent1", "192.168.0.12"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func Test_runNodes_StopOnError(t *testing.T) {
+	targets := []operator.Target{{Host: "node1"}, {Host: "node2"}, {Host: "node3"}}
+	options := operatorOptions{dryRun: true}
+
+	ran := []string{}
+	task := nodeTask{verb: "upgrade", running: "Upgrading", done: "upgraded", stopOnError: true}
+	err := runNodes(context.Background(), nil, targets, options, 1, task, func(op operator.Operator, out io.Writer) error {
+		ran = append(ran, op.(*operator.DryRunOperator).Host)
+		return fmt.Errorf("install failed")
+	})
+
+	if err == nil || err.Error() != "3 of 3 nodes failed to upgrade" {
+		t.Errorf("want every node counted as failed, got %v", err)
+	}
+	if len(ran) != 1 {
+		t.Errorf("want no node started after the first failure, got %v", ran)
+	}
+}
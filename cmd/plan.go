@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// clusterPlan describes a whole cluster for k2sup apply. Paths are
+// relative to the plan file.
+type clusterPlan struct {
+	Version      string `yaml:"version"`
+	Channel      string `yaml:"channel"`
+	VIP          string `yaml:"vip"`
+	VIPInterface string `yaml:"vipInterface"`
+
+	// AirgapDir holds the artifacts for installing without internet
+	// access, see airgapArtifacts
+	AirgapDir string `yaml:"airgapDir"`
+
+	// InstallMethod is auto, tar or rpm, InstallTarPrefix and RPMRepoURL
+	// apply to tar and rpm installs
+	InstallMethod    string `yaml:"installMethod"`
+	InstallTarPrefix string `yaml:"installTarPrefix"`
+	RPMRepoURL       string `yaml:"rpmRepoURL"`
+
+	// InstallScript replaces the install script from get.rke2.io
+	InstallScript planInstallScript `yaml:"installScript"`
+
+	// Registries is a containerd registry configuration file written to
+	// every node
+	Registries string `yaml:"registries"`
+
+	// Kubeconfig is where the kubeconfig is saved, with Context as the
+	// name of its context
+	Kubeconfig string `yaml:"kubeconfig"`
+	Context    string `yaml:"context"`
+	Merge      bool   `yaml:"merge"`
+
+	SSH planSSH `yaml:"ssh"`
+
+	// Servers are installed in order, the first one creates the cluster
+	Servers []planNode `yaml:"servers"`
+	Agents  []planNode `yaml:"agents"`
+}
+
+// planSSH holds the SSH settings shared by every node
+type planSSH struct {
+	User     string   `yaml:"user"`
+	Port     int      `yaml:"port"`
+	Keys     []string `yaml:"keys"`
+	Bastions []string `yaml:"bastions"`
+	Become   string   `yaml:"become"`
+}
+
+// planInstallScript is downloaded from URL or uploaded from File, and
+// verified against SHA256 when it is given
+type planInstallScript struct {
+	URL    string `yaml:"url"`
+	File   string `yaml:"file"`
+	SHA256 string `yaml:"sha256"`
+}
+
+// planNode is a server or agent, User and Port override the SSH settings
+type planNode struct {
+	Host   string   `yaml:"host"`
+	User   string   `yaml:"user"`
+	Port   int      `yaml:"port"`
+	Config string   `yaml:"config"`
+	Labels []string `yaml:"labels"`
+	Taints []string `yaml:"taints"`
+}
+
+// rke2NodeConfigFile holds the labels and taints given for a node in a
+// plan, RKE2 merges it with config.yaml
+const rke2NodeConfigFile = rke2ConfigPath + "config.yaml.d/50-k2sup.yaml"
+
+// loadPlan reads and validates the plan at path
+func loadPlan(path string) (clusterPlan, error) {
+	plan := clusterPlan{}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return plan, errors.Wrap(err, "unable to read the plan")
+	}
+	if err := yaml.UnmarshalStrict(data, &plan); err != nil {
+		return plan, errors.Wrapf(err, "unable to parse the plan %s", path)
+	}
+
+	if err := plan.validate(); err != nil {
+		return plan, errors.Wrapf(err, "invalid plan %s", path)
+	}
+
+	plan.resolvePaths(filepath.Dir(path))
+	return plan, nil
+}
+
+// validate checks the plan and fills in the defaults
+func (p *clusterPlan) validate() error {
+	if len(p.Servers) == 0 {
+		return fmt.Errorf("give at least one server")
+	}
+	if len(p.Version) == 0 && len(p.Channel) == 0 {
+		p.Channel = PinnedChannel
+	}
+	if len(p.InstallScript.URL) > 0 && len(p.InstallScript.File) > 0 {
+		return fmt.Errorf("give only one of installScript.url and installScript.file")
+	}
+	if len(p.AirgapDir) > 0 && (len(p.InstallScript.URL) > 0 || len(p.InstallScript.File) > 0) {
+		return fmt.Errorf("airgapDir uses the install.sh in the directory, installScript.url and installScript.file cannot be used with it")
+	}
+	if err := p.installMethod().validate(len(p.AirgapDir) > 0); err != nil {
+		return err
+	}
+	if len(p.InstallScript.URL) == 0 {
+		p.InstallScript.URL = defaultInstallScriptURL
+	}
+	if len(p.InstallScript.SHA256) > 0 {
+		sum, err := parseSHA256(p.InstallScript.SHA256)
+		if err != nil {
+			return err
+		}
+		p.InstallScript.SHA256 = sum
+	}
+	if len(p.VIPInterface) == 0 {
+		p.VIPInterface = "eth0"
+	}
+	if len(p.Kubeconfig) == 0 {
+		p.Kubeconfig = "kubeconfig"
+	}
+	if len(p.Context) == 0 {
+		p.Context = "default"
+	}
+
+	seen := map[string]bool{}
+	for i, node := range append(append([]planNode{}, p.Servers...), p.Agents...) {
+		if len(node.Host) == 0 {
+			return fmt.Errorf("node %d has no host", i+1)
+		}
+		if seen[node.Host] {
+			return fmt.Errorf("host %s is given more than once", node.Host)
+		}
+		seen[node.Host] = true
+	}
+
+	return nil
+}
+
+// installMethod returns the install method settings of the plan
+func (p *clusterPlan) installMethod() installMethod {
+	return installMethod{
+		method:     p.InstallMethod,
+		tarPrefix:  p.InstallTarPrefix,
+		rpmRepoURL: p.RPMRepoURL,
+	}
+}
+
+// resolvePaths makes every local path in the plan relative to dir
+func (p *clusterPlan) resolvePaths(dir string) {
+	resolve := func(path string) string {
+		if len(path) == 0 {
+			return path
+		}
+		path = expandPath(path)
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	p.AirgapDir = resolve(p.AirgapDir)
+	p.InstallScript.File = resolve(p.InstallScript.File)
+	p.Registries = resolve(p.Registries)
+	p.Kubeconfig = resolve(p.Kubeconfig)
+	for i, key := range p.SSH.Keys {
+		p.SSH.Keys[i] = resolve(key)
+	}
+	for _, nodes := range [][]planNode{p.Servers, p.Agents} {
+		for i := range nodes {
+			nodes[i].Config = resolve(nodes[i].Config)
+		}
+	}
+}
+
+// nodeConfig returns the RKE2 config for the labels and taints of node,
+// or an empty string when there are none
+func nodeConfig(node planNode) string {
+	config := strings.Builder{}
+	for _, setting := range []struct {
+		key    string
+		values []string
+	}{
+		{"node-label", node.Labels},
+		{"node-taint", node.Taints},
+	} {
+		if len(setting.values) == 0 {
+			continue
+		}
+		config.WriteString(setting.key + ":\n")
+		for _, value := range setting.values {
+			fmt.Fprintf(&config, "  - %q\n", value)
+		}
+	}
+	return config.String()
+}
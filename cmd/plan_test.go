@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+)
+
+func Test_loadPlan_DefaultsAndPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cluster.yaml")
+	plan := `registries: registries.yaml
+ssh:
+  keys: [keys/id_ed25519, /etc/k2sup/id_rsa]
+servers:
+  - host: server0
+    config: server-config.yaml
+agents:
+  - host: agent0
+`
+	if err := ioutil.WriteFile(path, []byte(plan), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadPlan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Channel != PinnedChannel {
+		t.Errorf("want channel %q, got %q", PinnedChannel, got.Channel)
+	}
+	if got.Context != "default" {
+		t.Errorf("want context %q, got %q", "default", got.Context)
+	}
+	for _, c := range []struct{ want, got string }{
+		{filepath.Join(dir, "registries.yaml"), got.Registries},
+		{filepath.Join(dir, "kubeconfig"), got.Kubeconfig},
+		{filepath.Join(dir, "keys/id_ed25519"), got.SSH.Keys[0]},
+		{"/etc/k2sup/id_rsa", got.SSH.Keys[1]},
+		{filepath.Join(dir, "server-config.yaml"), got.Servers[0].Config},
+		{"", got.Agents[0].Config},
+	} {
+		if c.got != c.want {
+			t.Errorf("want path %q, got %q", c.want, c.got)
+		}
+	}
+}
+
+func Test_loadPlan_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plans := map[string]string{
+		"no servers":     "agents:\n  - host: agent0\n",
+		"no host":        "servers:\n  - config: server.yaml\n",
+		"duplicate host": "servers:\n  - host: node0\nagents:\n  - host: node0\n",
+		"unknown key":    "servers:\n  - host: node0\n    lables: [a=b]\n",
+		"script sha256":  "installScript:\n  sha256: abc\nservers:\n  - host: node0\n",
+		"install method": "installMethod: deb\nservers:\n  - host: node0\n",
+	}
+
+	for name, plan := range plans {
+		path := filepath.Join(dir, "cluster.yaml")
+		if err := ioutil.WriteFile(path, []byte(plan), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadPlan(path); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+}
+
+func Test_nodeConfig(t *testing.T) {
+	got := nodeConfig(planNode{
+		Labels: []string{"disk=ssd"},
+		Taints: []string{"CriticalAddonsOnly=true:NoExecute"},
+	})
+	want := `node-label:
+  - "disk=ssd"
+node-taint:
+  - "CriticalAddonsOnly=true:NoExecute"
+`
+	if got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+
+	if got := nodeConfig(planNode{}); got != "" {
+		t.Errorf("want no config without labels or taints, got %q", got)
+	}
+}
+
+func Test_planTarget_Precedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config")
+	config := `Host node
+  HostName 10.0.0.2
+  IdentityFile /keys/node
+  ProxyJump jump
+`
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshConfig, err := operator.LoadSSHConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name         string
+		settings     planSSH
+		flags        []string
+		wantKeys     []string
+		wantBastions []string
+	}{
+		{"ssh config", planSSH{}, nil, []string{"/keys/node"}, []string{"jump"}},
+		// The connector tries --ssh-key when the target has no keys
+		{"flags", planSSH{}, []string{"--ssh-key=/keys/flag", "--bastion=flag-jump"}, nil, []string{"flag-jump"}},
+		{"plan", planSSH{Keys: []string{"/keys/plan"}, Bastions: []string{"plan-jump"}}, []string{"--ssh-key=/keys/flag", "--bastion=flag-jump"}, []string{"/keys/plan"}, []string{"plan-jump"}},
+	}
+	for _, c := range cases {
+		command := MakeApply()
+		if err := command.ParseFlags(c.flags); err != nil {
+			t.Fatal(err)
+		}
+
+		target, err := planTarget(command, sshConfig, c.settings, planNode{Host: "node"})
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if len(target.KeyPaths) == 0 {
+			target.KeyPaths = nil
+		}
+		if !reflect.DeepEqual(target.KeyPaths, c.wantKeys) {
+			t.Errorf("%s: want keys %q, got %q", c.name, c.wantKeys, target.KeyPaths)
+		}
+		bastions := []string{}
+		for _, bastion := range target.Bastions {
+			bastions = append(bastions, bastion.Host)
+		}
+		if !reflect.DeepEqual(bastions, c.wantBastions) {
+			t.Errorf("%s: want bastions %q, got %q", c.name, c.wantBastions, bastions)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// addConnectionFlags adds the flags shared by every command which connects
+// to hosts: how to log in over SSH and verify hosts, how to become root,
+// and how each step is run and logged. They are read by makeConnector,
+// readPasswords, makeBecomeOptions and makeAuditOptions.
+func addConnectionFlags(command *cobra.Command) {
+	command.Flags().StringArray("ssh-key", []string{}, "The ssh key to use for remote login, repeat the flag to try several keys (Default to the standard keys in ~/.ssh)")
+	command.Flags().String("ssh-cert", "", "An OpenSSH user certificate for the first --ssh-key (Default to the key path with -cert.pub appended, if present)")
+	command.Flags().String("ssh-config", "~/.ssh/config", "The OpenSSH client config used to resolve host aliases, users, ports, keys and ProxyJump")
+	command.Flags().String("known-hosts", "~/.ssh/known_hosts", "The known_hosts file used to verify host keys")
+	command.Flags().String("host-key-policy", operator.HostKeyPolicyTOFU, "Host key verification: strict, tofu (trust and record new hosts) or insecure")
+	command.Flags().String("host-ca", "", "A file of CA public keys, trust hosts presenting a certificate signed by one of them")
+	command.Flags().StringArray("bastion", []string{}, "Connect through a bastion (jump host) given as user@host:port, repeat the flag for a chain of bastions")
+	command.Flags().String("bastion-ssh-key", "", "The ssh key to use for bastion login (Default to the IdentityFile for the bastion in the ssh config, then --ssh-key)")
+	command.Flags().Bool("ssh-password-stdin", false, "Read the SSH password from stdin for password and keyboard-interactive login, or set K2SUP_SSH_PASSWORD")
+	command.Flags().Bool("ssh-copy-id", false, "Add the public key for --ssh-key to authorized_keys after logging in with a password")
+	command.Flags().Duration("ssh-timeout", 10*time.Second, "Timeout for each attempt to open an SSH connection")
+	command.Flags().Int("ssh-retries", 0, "Number of times to retry with backoff while a host refuses or times out SSH connections, such as while it boots")
+
+	command.Flags().Bool("sudo", true, "Use sudo for installation. e.g. set to false when using the root user and no sudo is available.")
+	command.Flags().String("become", "", "How to run commands as root: sudo, doas, su or none (Default sudo, or none with --sudo=false)")
+	command.Flags().Bool("sudo-password-stdin", false, "Read the password for --become from stdin, after the SSH password when both are read from stdin, or set K2SUP_SUDO_PASSWORD")
+	command.Flags().String("sudo-askpass", "", "A program which prints the password for --become, run with a prompt as its argument in the same way as SSH_ASKPASS")
+
+	command.Flags().Bool("dry-run", false, "Print each command and file which would be run or written on each host, without connecting to them")
+	command.Flags().Bool("print-command", false, "Print a command that you can use with SSH to manually recover from an error")
+	command.Flags().Duration("timeout", 0, "Timeout for each step run on a host, such as the install script or starting RKE2, e.g. 10m (Default no timeout)")
+	command.Flags().String("log-dir", "~/.k2sup/logs", "Keep a transcript of every command run on each host in <log-dir>/<server>/<host>-<timestamp>.log, set to \"\" to turn off")
+}
+
+// makeConnector creates the connector used for every SSH connection
+// made by a command, from the flags shared by install and join and the
+// SSH password read by readPasswords
+func makeConnector(command *cobra.Command, password string) (*operator.Connector, error) {
+	sshKeys, err := command.Flags().GetStringArray("ssh-key")
+	if err != nil {
+		return nil, err
+	}
+	knownHosts, err := command.Flags().GetString("known-hosts")
+	if err != nil {
+		return nil, err
+	}
+	policy, err := command.Flags().GetString("host-key-policy")
+	if err != nil {
+		return nil, err
+	}
+
+	sshCert, err := command.Flags().GetString("ssh-cert")
+	if err != nil {
+		return nil, err
+	}
+	hostCA, err := command.Flags().GetString("host-ca")
+	if err != nil {
+		return nil, err
+	}
+
+	copyPublicKey, err := command.Flags().GetBool("ssh-copy-id")
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, err := command.Flags().GetDuration("ssh-timeout")
+	if err != nil {
+		return nil, err
+	}
+	retries, err := command.Flags().GetInt("ssh-retries")
+	if err != nil {
+		return nil, err
+	}
+
+	return operator.NewConnector(operator.AuthOptions{
+		KeyPaths:       expandPaths(sshKeys),
+		CertPath:       expandPath(sshCert),
+		HostKeyPolicy:  policy,
+		KnownHostsPath: expandPath(knownHosts),
+		HostCAPath:     expandPath(hostCA),
+		Password:       password,
+		CopyPublicKey:  copyPublicKey,
+		Timeout:        timeout,
+		Retries:        retries,
+	})
+}
+
+// passwords are the SSH password and the password to become root
+type passwords struct {
+	ssh  string
+	sudo string
+}
+
+// readPasswords reads the SSH password for --ssh-password-stdin and then
+// the password to become root for --sudo-password-stdin, one line each,
+// so that both can be piped in whether or not any host is connected to.
+// A password which is not read from stdin is taken from
+// K2SUP_SSH_PASSWORD or K2SUP_SUDO_PASSWORD.
+func readPasswords(command *cobra.Command) (passwords, error) {
+	sshStdin, err := command.Flags().GetBool("ssh-password-stdin")
+	if err != nil {
+		return passwords{}, err
+	}
+	sudoStdin, err := command.Flags().GetBool("sudo-password-stdin")
+	if err != nil {
+		return passwords{}, err
+	}
+
+	res := passwords{
+		ssh:  os.Getenv("K2SUP_SSH_PASSWORD"),
+		sudo: os.Getenv("K2SUP_SUDO_PASSWORD"),
+	}
+	if sshStdin {
+		if res.ssh, err = readSecretStdin(); err != nil {
+			return res, errors.Wrap(err, "unable to read the SSH password from stdin")
+		}
+	}
+	if sudoStdin {
+		if res.sudo, err = readSecretStdin(); err != nil {
+			return res, errors.Wrap(err, "unable to read the password to become root from stdin")
+		}
+	}
+	return res, nil
+}
+
+// stdin is shared so that more than one secret can be read from it,
+// one per line
+var stdin = bufio.NewReader(os.Stdin)
+
+// readSecretStdin reads a single line from stdin
+func readSecretStdin() (string, error) {
+	line, err := stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func loadSSHConfig(command *cobra.Command) (*operator.SSHConfig, error) {
+	path, err := command.Flags().GetString("ssh-config")
+	if err != nil {
+		return nil, err
+	}
+
+	return operator.LoadSSHConfig(expandPath(path))
+}
+
+// resolveSSHTarget looks up alias in the ssh config, any of the given
+// flags which were set explicitly take precedence over the ssh config.
+// The flags are checked in order, so a more specific flag such as
+// --server-user can come before the general --user.
+func resolveSSHTarget(command *cobra.Command, config *operator.SSHConfig, alias string, userFlags, portFlags []string) (operator.Target, error) {
+	hostConfig := config.Lookup(alias)
+	target := operator.Target{
+		Host: hostConfig.HostName,
+	}
+
+	userFlag := changedFlag(command, userFlags)
+	if len(userFlag) == 0 && len(hostConfig.User) > 0 {
+		target.User = hostConfig.User
+	} else {
+		if len(userFlag) == 0 {
+			userFlag = userFlags[len(userFlags)-1]
+		}
+		user, err := command.Flags().GetString(userFlag)
+		if err != nil {
+			return target, err
+		}
+		target.User = user
+	}
+
+	portFlag := changedFlag(command, portFlags)
+	if len(portFlag) == 0 && hostConfig.Port > 0 {
+		target.Port = hostConfig.Port
+	} else {
+		if len(portFlag) == 0 {
+			portFlag = portFlags[len(portFlags)-1]
+		}
+		port, err := command.Flags().GetInt(portFlag)
+		if err != nil {
+			return target, err
+		}
+		target.Port = port
+	}
+
+	if !command.Flags().Changed("ssh-key") {
+		target.KeyPaths = hostConfig.IdentityFiles
+	}
+
+	bastions, err := command.Flags().GetStringArray("bastion")
+	if err != nil {
+		return target, err
+	}
+	if !command.Flags().Changed("bastion") && hostConfig.ProxyJump != nil {
+		bastions = hostConfig.ProxyJump
+	}
+
+	bastionKey, err := command.Flags().GetString("bastion-ssh-key")
+	if err != nil {
+		return target, err
+	}
+
+	for _, spec := range bastions {
+		bastion, err := resolveBastion(config, spec, target.User, bastionKey)
+		if err != nil {
+			return target, err
+		}
+		target.Bastions = append(target.Bastions, bastion)
+	}
+
+	return target, nil
+}
+
+// resolveBastion resolves a bastion given as [user@]host[:port], where
+// host may be an alias from the ssh config. A key given with
+// --bastion-ssh-key takes precedence over IdentityFile.
+func resolveBastion(config *operator.SSHConfig, spec, defaultUser, bastionKey string) (operator.Target, error) {
+	user, host, port, err := parseBastion(spec)
+	if err != nil {
+		return operator.Target{}, err
+	}
+
+	hostConfig := config.Lookup(host)
+	bastion := operator.Target{
+		Host:     hostConfig.HostName,
+		User:     user,
+		Port:     port,
+		KeyPaths: hostConfig.IdentityFiles,
+	}
+
+	if len(bastion.User) == 0 {
+		bastion.User = hostConfig.User
+	}
+	if len(bastion.User) == 0 {
+		bastion.User = defaultUser
+	}
+	if bastion.Port == 0 {
+		bastion.Port = hostConfig.Port
+	}
+	if bastion.Port == 0 {
+		bastion.Port = 22
+	}
+	if len(bastionKey) > 0 {
+		bastion.KeyPaths = []string{expandPath(bastionKey)}
+	}
+
+	return bastion, nil
+}
+
+// parseBastion parses a bastion given as [user@]host[:port], the user
+// is empty and the port is zero when they were not given
+func parseBastion(spec string) (string, string, int, error) {
+	user := ""
+	hostPort := spec
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		user = spec[:i]
+		hostPort = spec[i+1:]
+	}
+
+	port := 0
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = strings.Trim(hostPort, "[]")
+	} else if port, err = strconv.Atoi(portStr); err != nil {
+		return "", "", 0, fmt.Errorf("invalid port in bastion %q", spec)
+	}
+
+	if len(host) == 0 {
+		return "", "", 0, fmt.Errorf("invalid bastion %q, use the form user@host:port", spec)
+	}
+
+	return user, host, port, nil
+}
+
+func changedFlag(command *cobra.Command, names []string) string {
+	for _, name := range names {
+		if command.Flags().Changed(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+func expandPaths(paths []string) []string {
+	res := make([]string, len(paths))
+	for i, path := range paths {
+		res[i] = expandPath(path)
+	}
+	return res
+}
+
+// stdErrTailLines is how much of stderr is shown when a command fails
+const stdErrTailLines = 20
+
+// commandFailed wraps err with message and the exit code, followed by
+// the end of the stderr captured from the failed command, which is
+// otherwise easy to lose in streamed output
+func commandFailed(err error, res operator.CommandRes, message string) error {
+	err = explainBecome(err)
+	if res.ExitCode > 0 {
+		err = errors.Wrapf(err, "%s, exit code %d", message, res.ExitCode)
+	} else {
+		err = errors.Wrap(err, message)
+	}
+
+	if len(res.StdErr) > 0 {
+		return &stdErrTailError{err: err, tail: res.StdErrTail(stdErrTailLines)}
+	}
+	return err
+}
+
+// stdErrTailError is an error from a failed command followed by the end
+// of its stderr
+type stdErrTailError struct {
+	err  error
+	tail string
+}
+
+func (e *stdErrTailError) Error() string {
+	return fmt.Sprintf("%s\nstderr (last %d lines):\n%s", e.err, stdErrTailLines, e.tail)
+}
+
+// Cause returns the error without the stderr, for errors.Cause
+func (e *stdErrTailError) Cause() error {
+	return e.err
+}
+
+// executePhase runs a step of the install on op, cancelling it when
+// it runs for longer than timeout, or at all when timeout is zero
+func executePhase(ctx context.Context, op operator.CommandOperator, timeout time.Duration, command string) (operator.CommandRes, error) {
+	return executePhaseStdio(ctx, op, timeout, command, true)
+}
+
+// executePhaseStdio is executePhase, only streaming the output of the
+// command when stream is set
+func executePhaseStdio(ctx context.Context, op operator.CommandOperator, timeout time.Duration, command string, stream bool) (operator.CommandRes, error) {
+	return withPhaseTimeout(ctx, timeout, func(ctx context.Context) (operator.CommandRes, error) {
+		return op.ExecuteStdioContext(ctx, command, stream)
+	})
+}
+
+// executeSecret is executePhase for a command which prints a secret,
+// such as the join token, which is neither streamed nor logged
+func executeSecret(ctx context.Context, op operator.CommandOperator, timeout time.Duration, command string) (operator.CommandRes, error) {
+	return withPhaseTimeout(ctx, timeout, func(ctx context.Context) (operator.CommandRes, error) {
+		return operator.ExecuteSecret(ctx, op, command)
+	})
+}
+
+// withPhaseTimeout runs execute, cancelling it after timeout unless
+// timeout is zero
+func withPhaseTimeout(ctx context.Context, timeout time.Duration, execute func(context.Context) (operator.CommandRes, error)) (operator.CommandRes, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	res, err := execute(ctx)
+	if err == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	return res, err
+}
+
+// operatorOptions configures the operators opened by openOperator
+type operatorOptions struct {
+	local  bool
+	dryRun bool
+	become becomeOptions
+	audit  auditOptions
+
+	// stdout and stderr replace os.Stdout and os.Stderr for the output
+	// of commands when they are set, stdout also receives the messages
+	// printed while connecting
+	stdout io.Writer
+	stderr io.Writer
+
+	// connect opens each node in place of the connector, in tests
+	connect func(context.Context, operator.Target) (operator.Operator, error)
+}
+
+// outputOperator is implemented by operators whose output can be
+// streamed somewhere other than os.Stdout and os.Stderr
+type outputOperator interface {
+	SetOutput(stdout, stderr io.Writer)
+}
+
+func (o operatorOptions) setOutput(op outputOperator) {
+	if o.stdout != nil {
+		op.SetOutput(o.stdout, o.stderr)
+	}
+}
+
+// openOperator connects to target, or returns an operator for this
+// machine when local is set. With dryRun nothing is connected to and
+// every command and upload is printed instead.
+func openOperator(ctx context.Context, connector *operator.Connector, target operator.Target, options operatorOptions) (operator.Operator, error) {
+	host := target.Host
+	if options.local {
+		host = "localhost"
+	}
+
+	if options.dryRun {
+		dryRunOperator := operator.NewDryRunOperator(host)
+		dryRunOperator.Secrets = options.audit.secrets
+		if err := options.become.apply(dryRunOperator); err != nil {
+			return nil, err
+		}
+		options.setOutput(dryRunOperator)
+		return dryRunOperator, nil
+	}
+
+	if options.local {
+		execOperator := &operator.ExecOperator{}
+		if err := options.become.apply(execOperator); err != nil {
+			return nil, err
+		}
+		options.setOutput(execOperator)
+		return options.audit.wrap(execOperator, host)
+	}
+
+	if options.connect != nil {
+		return options.connect(ctx, target)
+	}
+
+	sshOperator, err := connector.Dial(ctx, target, options.stdout)
+	if err != nil {
+		return nil, err
+	}
+	if err := options.become.apply(sshOperator); err != nil {
+		sshOperator.Close()
+		return nil, err
+	}
+	options.setOutput(sshOperator)
+
+	return options.audit.wrap(sshOperator, host)
+}
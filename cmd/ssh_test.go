@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func Test_parseBastion(t *testing.T) {
+	cases := []struct {
+		spec string
+		user string
+		host string
+		port int
+	}{
+		{spec: "bastion.example.com", host: "bastion.example.com"},
+		{spec: "ops@bastion.example.com", user: "ops", host: "bastion.example.com"},
+		{spec: "ops@bastion.example.com:2222", user: "ops", host: "bastion.example.com", port: 2222},
+		{spec: "10.0.0.1:2222", host: "10.0.0.1", port: 2222},
+		{spec: "ops@[2001:db8::1]:2222", user: "ops", host: "2001:db8::1", port: 2222},
+		{spec: "[2001:db8::1]", host: "2001:db8::1"},
+		{spec: "ops@corp@bastion", user: "ops@corp", host: "bastion"},
+	}
+	for _, c := range cases {
+		user, host, port, err := parseBastion(c.spec)
+		if err != nil {
+			t.Errorf("%s: %s", c.spec, err)
+			continue
+		}
+		if user != c.user || host != c.host || port != c.port {
+			t.Errorf("%s: want %q %q %d, got %q %q %d", c.spec, c.user, c.host, c.port, user, host, port)
+		}
+	}
+
+	for _, spec := range []string{"ops@", "ops@bastion:ssh", ""} {
+		if _, _, _, err := parseBastion(spec); err == nil {
+			t.Errorf("%q: want an error", spec)
+		}
+	}
+}
+
+func Test_resolveBastion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-ssh-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config")
+	config := `Host jump
+  HostName 10.0.0.1
+  User ops
+  Port 2222
+  IdentityFile /keys/jump
+`
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshConfig, err := operator.LoadSSHConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		spec       string
+		bastionKey string
+		want       operator.Target
+	}{
+		{
+			spec: "jump",
+			want: operator.Target{Host: "10.0.0.1", User: "ops", Port: 2222, KeyPaths: []string{"/keys/jump"}},
+		},
+		{
+			spec: "admin@jump:22",
+			want: operator.Target{Host: "10.0.0.1", User: "admin", Port: 22, KeyPaths: []string{"/keys/jump"}},
+		},
+		{
+			spec:       "jump",
+			bastionKey: "/keys/bastion",
+			want:       operator.Target{Host: "10.0.0.1", User: "ops", Port: 2222, KeyPaths: []string{"/keys/bastion"}},
+		},
+		{
+			spec: "bastion.example.com",
+			want: operator.Target{Host: "bastion.example.com", User: "root", Port: 22},
+		},
+	}
+	for _, c := range cases {
+		got, err := resolveBastion(sshConfig, c.spec, "root", c.bastionKey)
+		if err != nil {
+			t.Errorf("%s: %s", c.spec, err)
+			continue
+		}
+		if len(got.KeyPaths) == 0 {
+			got.KeyPaths = nil
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: want %+v, got %+v", c.spec, c.want, got)
+		}
+	}
+}
+
+func newPasswordsCommand(sshStdin, sudoStdin bool) *cobra.Command {
+	command := &cobra.Command{}
+	command.Flags().Bool("ssh-password-stdin", sshStdin, "")
+	command.Flags().Bool("sudo-password-stdin", sudoStdin, "")
+	return command
+}
+
+func Test_readPasswords_Order(t *testing.T) {
+	defer func(reader *bufio.Reader) { stdin = reader }(stdin)
+	stdin = bufio.NewReader(strings.NewReader("sshpw\r\nsudopw\n"))
+
+	got, err := readPasswords(newPasswordsCommand(true, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (passwords{ssh: "sshpw", sudo: "sudopw"}); got != want {
+		t.Errorf("want the SSH password first, then the sudo password %+v, got %+v", want, got)
+	}
+}
+
+func Test_readPasswords_Env(t *testing.T) {
+	defer func(reader *bufio.Reader) { stdin = reader }(stdin)
+	os.Setenv("K2SUP_SSH_PASSWORD", "ssh-env")
+	defer os.Unsetenv("K2SUP_SSH_PASSWORD")
+	os.Setenv("K2SUP_SUDO_PASSWORD", "sudo-env")
+	defer os.Unsetenv("K2SUP_SUDO_PASSWORD")
+
+	// stdin takes precedence, and without the flag stdin is left unread
+	stdin = bufio.NewReader(strings.NewReader("sudo-stdin\nunread\n"))
+	got, err := readPasswords(newPasswordsCommand(false, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (passwords{ssh: "ssh-env", sudo: "sudo-stdin"}); got != want {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+	if line, _ := readSecretStdin(); line != "unread" {
+		t.Errorf("want only one line read, got %q next", line)
+	}
+
+	// A password without a trailing newline is still read
+	stdin = bufio.NewReader(strings.NewReader("last-line"))
+	got, err = readPasswords(newPasswordsCommand(true, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (passwords{ssh: "last-line", sudo: "sudo-env"}); got != want {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
+
+func Test_commandFailed_ExitCode(t *testing.T) {
+	res, err := operator.ExecOperator{}.ExecuteStdio(`sh -c 'echo x >&2; exit 3'`, false)
+	if err == nil {
+		t.Fatalf("want the command to fail")
+	}
+
+	got := commandFailed(err, res, "error installing RKE2").Error()
+	if want := "error installing RKE2, exit code 3: Process exited with status 3\nstderr (last 20 lines):\nx"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	res.StdErr = nil
+	got = commandFailed(err, res, "error installing RKE2").Error()
+	if want := "error installing RKE2, exit code 3: Process exited with status 3"; got != want {
+		t.Errorf("want %q without stderr, got %q", want, got)
+	}
+}
+
+func Test_executePhaseStdio_Timeout(t *testing.T) {
+	start := time.Now()
+	_, err := executePhaseStdio(context.Background(), &operator.ExecOperator{}, 100*time.Millisecond, "sleep 5", false)
+	if err == nil || err.Error() != "timed out after 100ms" {
+		t.Errorf("want the phase to time out, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("want the phase stopped after the timeout, took %s", elapsed)
+	}
+}
+
+func Test_executePhaseStdio_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	_, err := executePhaseStdio(ctx, &operator.ExecOperator{}, time.Minute, "sleep 5", false)
+	if err != context.Canceled {
+		t.Errorf("want context.Canceled, got: %v", err)
+	}
+}
+
+func Test_addConnectionFlags_Shared(t *testing.T) {
+	want := &cobra.Command{}
+	addConnectionFlags(want)
+
+	commands := []*cobra.Command{MakeInstall(), MakeJoin(), MakeApply(), MakeUninstall(), MakeUpgrade()}
+	for _, command := range commands {
+		want.Flags().VisitAll(func(flag *pflag.Flag) {
+			got := command.Flags().Lookup(flag.Name)
+			if got == nil {
+				t.Errorf("%s: want --%s", command.Name(), flag.Name)
+				return
+			}
+			if got.Usage != flag.Usage || got.DefValue != flag.DefValue {
+				t.Errorf("%s: want --%s defined by addConnectionFlags, got %q", command.Name(), flag.Name, got.Usage)
+			}
+		})
+	}
+}
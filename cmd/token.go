@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// getAgentTokenCommand prints the token for agents, servers started
+// without a separate agent-token only have the node-token
+const getAgentTokenCommand = "cat /var/lib/rancher/rke2/server/agent-token 2>/dev/null || cat /var/lib/rancher/rke2/server/node-token\n"
+
+// joinTokens are given to join rather than read from the server over SSH
+type joinTokens struct {
+	// server joins servers, and agents too when there is no agent token
+	server string
+	// agent only joins agents, so that they never hold the server token
+	agent string
+}
+
+// given is true when a token was given, so the server is not needed
+func (t joinTokens) given() bool {
+	return len(t.server) > 0 || len(t.agent) > 0
+}
+
+// forNode returns the token a server or an agent joins with
+func (t joinTokens) forNode(server bool) string {
+	if server {
+		return t.server
+	}
+	return firstString(t.agent, t.server)
+}
+
+// makeJoinTokens reads --token, --token-file or K2SUP_TOKEN, and
+// --agent-token, --agent-token-file or K2SUP_AGENT_TOKEN
+func makeJoinTokens(command *cobra.Command) (joinTokens, error) {
+	server, err := readToken(command, "token", "K2SUP_TOKEN")
+	if err != nil {
+		return joinTokens{}, err
+	}
+	agent, err := readToken(command, "agent-token", "K2SUP_AGENT_TOKEN")
+	if err != nil {
+		return joinTokens{}, err
+	}
+	return joinTokens{server: server, agent: agent}, nil
+}
+
+// readToken reads the token from the flag called name, the file given
+// with the flag name-file, or else the environment variable env
+func readToken(command *cobra.Command, name, env string) (string, error) {
+	token, err := command.Flags().GetString(name)
+	if err != nil {
+		return "", err
+	}
+	tokenFile, err := command.Flags().GetString(name + "-file")
+	if err != nil {
+		return "", err
+	}
+
+	if len(token) > 0 && len(tokenFile) > 0 {
+		return "", fmt.Errorf("give only one of --%s and --%s-file", name, name)
+	}
+	if len(tokenFile) > 0 {
+		data, err := ioutil.ReadFile(expandPath(tokenFile))
+		if err != nil {
+			return "", errors.Wrapf(err, "unable to read --%s-file", name)
+		}
+		if token = strings.TrimSpace(string(data)); len(token) == 0 {
+			return "", fmt.Errorf("the --%s-file %s is empty", name, tokenFile)
+		}
+		return token, nil
+	}
+	if len(token) > 0 {
+		return strings.TrimSpace(token), nil
+	}
+	return strings.TrimSpace(os.Getenv(env)), nil
+}
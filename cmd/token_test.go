@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func newTokenCommand() *cobra.Command {
+	command := &cobra.Command{}
+	command.Flags().String("token", "", "")
+	command.Flags().String("token-file", "", "")
+	command.Flags().String("agent-token", "", "")
+	command.Flags().String("agent-token-file", "", "")
+	return command
+}
+
+func Test_makeJoinTokens(t *testing.T) {
+	f, err := ioutil.TempFile("", "k2sup-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("K10server::server:secret\n")
+	f.Close()
+
+	os.Setenv("K2SUP_AGENT_TOKEN", "agent-secret")
+	defer os.Unsetenv("K2SUP_AGENT_TOKEN")
+
+	command := newTokenCommand()
+	command.Flags().Set("token-file", f.Name())
+
+	got, err := makeJoinTokens(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := joinTokens{server: "K10server::server:secret", agent: "agent-secret"}
+	if got != want {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+
+	if token := got.forNode(true); token != want.server {
+		t.Errorf("want servers to join with the server token, got %q", token)
+	}
+	if token := got.forNode(false); token != want.agent {
+		t.Errorf("want agents to join with the agent token, got %q", token)
+	}
+	if token := (joinTokens{server: "server-secret"}).forNode(false); token != "server-secret" {
+		t.Errorf("want agents to join with the server token without an agent token, got %q", token)
+	}
+}
+
+func Test_makeJoinTokens_FlagAndFile(t *testing.T) {
+	command := newTokenCommand()
+	command.Flags().Set("token", "secret")
+	command.Flags().Set("token-file", "token.txt")
+
+	if _, err := makeJoinTokens(command); err == nil {
+		t.Errorf("want an error when both --token and --token-file are given")
+	}
+}
+
+func Test_makeConfig_AgentToken(t *testing.T) {
+	got := makeConfig("192.168.0.10", "server-secret", "agent-secret")
+	want := "server: https://192.168.0.10:9345 \ntoken: server-secret\nagent-token: agent-secret\n"
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,413 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// etcdRemoveAnnotation asks the servers to remove the etcd member of a
+// node before it is deleted
+const etcdRemoveAnnotation = "etcd.rke2.cattle.io/remove=true"
+
+// etcdRemovedAnnotation is set on the node by the servers once its etcd
+// member has been removed, escaped for a kubectl jsonpath
+const etcdRemovedAnnotation = `etcd\.rke2\.cattle\.io/removed-node-name`
+
+// etcdRemoveTimeout is how long to wait for the servers to remove the
+// etcd member of a node
+const etcdRemoveTimeout = 2 * time.Minute
+
+// isServerCommand succeeds on nodes which run an RKE2 server with
+// embedded etcd
+const isServerCommand = "test -d /var/lib/rancher/rke2/server/db/etcd"
+
+func MakeUninstall() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "uninstall",
+		Short: "Remove RKE2 from a remote host and the cluster",
+		Long: `Remove RKE2 from a remote host. When a server is given the node is
+drained and deleted from the cluster first, and servers leave etcd
+before RKE2 is stopped.
+
+` + SupportMsg,
+		Example: `  k2sup uninstall --host HOST --server-host SERVER --drain
+
+  k2sup uninstall --ip IP --user root`,
+		SilenceUsage: true,
+	}
+
+	command.Flags().IP("ip", net.ParseIP("127.0.0.1"), "Public IP of the node to remove RKE2 from")
+	command.Flags().String("host", "", "Public hostname of the node to remove RKE2 from")
+	command.Flags().String("user", "root", "Username for SSH login")
+	command.Flags().String("node-name", "", "The name of the node in the cluster (Default to the hostname of the node)")
+
+	command.Flags().String("server-host", "", "Public hostname or IP of another RKE2 server, used to drain and delete the node (Default to leave the cluster as it is)")
+	command.Flags().String("server-user", "root", "Server username for SSH login (Default to --user)")
+	command.Flags().Int("server-ssh-port", 22, "The port on which to connect to server for ssh (Default to --ssh-port)")
+
+	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
+
+	addConnectionFlags(command)
+
+	command.Flags().Bool("drain", false, "Cordon and drain the node through --server-host before removing it")
+	command.Flags().Duration("drain-timeout", 5*time.Minute, "How long to wait for the node to drain")
+	command.Flags().String("install-tar-prefix", "", "Where a tar install put RKE2, if it was given to install or join (Default /usr/local)")
+
+	command.Flags().String("local-path", "kubeconfig", "Local kubeconfig file to remove the contexts for the node from")
+	command.Flags().String("context", "", "The kubeconfig context to remove (Default to the contexts whose server is the node)")
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		fmt.Printf("Running: k2sup uninstall\n")
+
+		ip, err := command.Flags().GetIP("ip")
+		if err != nil {
+			return err
+		}
+		host, err := command.Flags().GetString("host")
+		if err != nil {
+			return err
+		}
+		if len(host) == 0 {
+			host = ip.String()
+		}
+
+		serverHost, err := command.Flags().GetString("server-host")
+		if err != nil {
+			return err
+		}
+
+		drain, err := command.Flags().GetBool("drain")
+		if err != nil {
+			return err
+		}
+		if drain && len(serverHost) == 0 {
+			return fmt.Errorf("give --server-host to drain the node through")
+		}
+		drainTimeout, err := command.Flags().GetDuration("drain-timeout")
+		if err != nil {
+			return err
+		}
+		name, err := command.Flags().GetString("node-name")
+		if err != nil {
+			return err
+		}
+		tarPrefix, err := command.Flags().GetString("install-tar-prefix")
+		if err != nil {
+			return err
+		}
+		localKubeconfig, err := command.Flags().GetString("local-path")
+		if err != nil {
+			return err
+		}
+		kubeContext, err := command.Flags().GetString("context")
+		if err != nil {
+			return err
+		}
+		printCommand, err := command.Flags().GetBool("print-command")
+		if err != nil {
+			return err
+		}
+		timeout, err := command.Flags().GetDuration("timeout")
+		if err != nil {
+			return err
+		}
+		dryRun, err := command.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+		passwords, err := readPasswords(command)
+		if err != nil {
+			return err
+		}
+		become, err := makeBecomeOptions(command, passwords.sudo)
+		if err != nil {
+			return err
+		}
+
+		openSSHConfig, err := loadSSHConfig(command)
+		if err != nil {
+			return err
+		}
+		target, err := resolveSSHTarget(command, openSSHConfig, host, []string{"user"}, []string{"ssh-port"})
+		if err != nil {
+			return err
+		}
+		host = target.Host
+
+		var serverTarget operator.Target
+		if len(serverHost) > 0 {
+			serverTarget, err = resolveSSHTarget(command, openSSHConfig, serverHost, []string{"server-user", "user"}, []string{"server-ssh-port", "ssh-port"})
+			if err != nil {
+				return err
+			}
+			serverHost = serverTarget.Host
+			if serverHost == host {
+				return fmt.Errorf("give another server with --server-host, the node cannot remove itself from the cluster")
+			}
+		}
+
+		audit, err := makeAuditOptions(command, firstString(serverHost, host))
+		if err != nil {
+			return err
+		}
+		options := operatorOptions{
+			dryRun: dryRun,
+			become: become,
+			audit:  audit,
+		}
+
+		ctx := command.Context()
+
+		var connector *operator.Connector
+		if !dryRun {
+			connector, err = makeConnector(command, passwords.ssh)
+			if err != nil {
+				return err
+			}
+			defer connector.Close()
+		}
+
+		nodeOperator, err := openOperator(ctx, connector, target, options)
+		if err != nil {
+			return errors.Wrapf(err, "unable to connect to %s", host)
+		}
+		defer nodeOperator.Close()
+
+		isServer := false
+		if res, err := nodeOperator.ExecuteStdioContext(ctx, isServerCommand, false); err == nil {
+			isServer = true
+		} else if err == operator.ErrPasswordRequired || err == operator.ErrPasswordIncorrect || ctx.Err() != nil {
+			return commandFailed(err, res, "unable to check the node")
+		}
+
+		var serverOperator operator.Operator
+		if len(serverHost) > 0 {
+			if len(name) == 0 {
+				if name, err = nodeName(ctx, nodeOperator, ""); err != nil {
+					return err
+				}
+				if dryRun {
+					name = dryRunNodeName
+				}
+			}
+
+			serverOperator, err = openOperator(ctx, connector, serverTarget, options)
+			if err != nil {
+				return errors.Wrapf(err, "unable to connect to %s", serverHost)
+			}
+			defer serverOperator.Close()
+
+			fmt.Printf("Removing node %s from the cluster through %s\n", name, serverHost)
+		} else {
+			fmt.Printf("No --server-host given, the node is left in the cluster\n")
+		}
+
+		fmt.Printf("Uninstalling RKE2 from %s\n", host)
+		for _, step := range uninstallSteps(name, serverOperator != nil, isServer, drain, drainTimeout, tarPrefix) {
+			stepOperator := operator.CommandOperator(nodeOperator)
+			if step.onServer {
+				stepOperator = serverOperator
+			}
+			if printCommand {
+				fmt.Printf("ssh: %s\n", step.command)
+			}
+			if res, err := executePhase(ctx, stepOperator, timeout, step.command); err != nil {
+				return commandFailed(err, res, step.failure)
+			}
+		}
+
+		return removeKubeconfigContexts(expandPath(localKubeconfig), kubeContext, host, dryRun)
+	}
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		if _, err := command.Flags().GetIP("ip"); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	return command
+}
+
+// uninstallStep is a command run on the node, or on the server when
+// onServer is set
+type uninstallStep struct {
+	onServer bool
+	command  string
+	failure  string
+}
+
+// uninstallSteps returns the commands which remove the node called name.
+// With a server the node is drained, leaves etcd and is deleted, after
+// RKE2 is stopped so that it cannot register again.
+func uninstallSteps(name string, withServer, isServer, drain bool, drainTimeout time.Duration, tarPrefix string) []uninstallStep {
+	steps := []uninstallStep{}
+	quotedName := operator.ShellQuote(name)
+
+	if withServer && drain {
+		steps = append(steps,
+			uninstallStep{true, kubectl("cordon", quotedName), "unable to cordon the node"},
+			uninstallStep{true, drainCommand(name, drainTimeout), "unable to drain the node"},
+		)
+	}
+	if withServer && isServer {
+		steps = append(steps,
+			uninstallStep{true, kubectl("annotate node", quotedName, etcdRemoveAnnotation, "--overwrite"), "unable to remove the node from etcd"},
+			uninstallStep{true, waitEtcdRemovedCommand(name, etcdRemoveTimeout, nodeWaitInterval), "unable to remove the node from etcd"},
+		)
+	}
+
+	scriptPath := rke2BinPath(tarPrefix)
+	steps = append(steps, uninstallStep{false, joinWords(scriptPath, "rke2-killall.sh"), "unable to stop RKE2"})
+
+	if withServer {
+		steps = append(steps, uninstallStep{true, kubectl("delete node", quotedName, "--ignore-not-found"), "unable to delete the node"})
+	}
+
+	files := []string{
+		rke2ConfigFile,
+		containerdRegistriesFile,
+		rke2JoinConfigFile,
+		rke2NodeConfigFile,
+		path.Join(rke2ManifestsDir, "vip.yaml"),
+		installScriptPath,
+		airgapArtifactsPath,
+	}
+	return append(steps,
+		uninstallStep{false, joinWords(scriptPath, "rke2-uninstall.sh"), "unable to uninstall RKE2"},
+		uninstallStep{false, "rm -rf " + strings.Join(files, " "), "unable to remove the files uploaded by k2sup"},
+	)
+}
+
+// waitEtcdRemovedCommand polls every interval until the servers have
+// removed the etcd member of the node called name, so that RKE2 is not
+// stopped while the cluster still counts it towards quorum
+func waitEtcdRemovedCommand(name string, timeout, interval time.Duration) string {
+	removed := kubectl("get node", operator.ShellQuote(name), "-o", "jsonpath='{.metadata.annotations."+etcdRemovedAnnotation+"}'")
+	return fmt.Sprintf(`i=0; until [ -n "$(%s)" ]; do i=$((i+1)); if [ "$i" -gt %d ]; then echo "the etcd member was not removed within %s" >&2; exit 1; fi; sleep %d; done`,
+		removed, int(timeout/interval), timeout, int(interval/time.Second))
+}
+
+// drainCommand evicts the pods from the node called name, other than
+// those of DaemonSets which would only be scheduled again
+func drainCommand(name string, timeout time.Duration) string {
+	return kubectl("drain", operator.ShellQuote(name), "--ignore-daemonsets", "--delete-emptydir-data", "--timeout="+timeout.String())
+}
+
+// rke2BinPath adds the directory of the rke2 binary and scripts to PATH,
+// as a tar install puts them outside of the secure_path used by sudo
+func rke2BinPath(tarPrefix string) string {
+	return `PATH="$PATH:` + path.Join(firstString(tarPrefix, "/usr/local"), "bin") + `"`
+}
+
+// removeKubeconfigContexts deletes kubeContext, or else every context for
+// a cluster served from host, from the kubeconfig at path
+func removeKubeconfigContexts(path, kubeContext, host string, dryRun bool) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to read the kubeconfig")
+	}
+
+	contexts := []kubeconfigContext{}
+	if len(kubeContext) > 0 {
+		contexts = append(contexts, kubeconfigContext{Name: kubeContext})
+	} else if contexts, err = hostContexts(data, host); err != nil {
+		return errors.Wrapf(err, "unable to parse the kubeconfig %s", path)
+	}
+
+	absPath, _ := filepath.Abs(path)
+	for _, c := range contexts {
+		if dryRun {
+			fmt.Printf("Dry run: the context %s would be removed from %s\n", c.Name, absPath)
+			continue
+		}
+
+		fmt.Printf("Removing the context %s from %s\n", c.Name, absPath)
+		deletes := [][]string{{"delete-context", c.Name}}
+		if len(c.Context.Cluster) > 0 {
+			deletes = append(deletes, []string{"delete-cluster", c.Context.Cluster})
+		}
+		if len(c.Context.User) > 0 {
+			deletes = append(deletes, []string{"unset", "users." + c.Context.User})
+		}
+		for _, args := range deletes {
+			cmd := exec.Command("kubectl", append([]string{"config", "--kubeconfig", absPath}, args...)...)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("could not %s from the kubeconfig: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+			}
+		}
+	}
+
+	return nil
+}
+
+// kubeconfigContext is the part of a kubeconfig context which names its
+// cluster and user
+type kubeconfigContext struct {
+	Name    string `yaml:"name"`
+	Context struct {
+		Cluster string `yaml:"cluster"`
+		User    string `yaml:"user"`
+	} `yaml:"context"`
+}
+
+// hostContexts returns the contexts whose cluster server is host, the
+// user and cluster are only included when no other context uses them
+func hostContexts(kubeconfig []byte, host string) ([]kubeconfigContext, error) {
+	config := struct {
+		Clusters []struct {
+			Name    string `yaml:"name"`
+			Cluster struct {
+				Server string `yaml:"server"`
+			} `yaml:"cluster"`
+		} `yaml:"clusters"`
+		Contexts []kubeconfigContext `yaml:"contexts"`
+	}{}
+	if err := yaml.Unmarshal(kubeconfig, &config); err != nil {
+		return nil, err
+	}
+
+	hostClusters := map[string]bool{}
+	for _, cluster := range config.Clusters {
+		if u, err := url.Parse(cluster.Cluster.Server); err == nil && u.Hostname() == host {
+			hostClusters[cluster.Name] = true
+		}
+	}
+
+	clusterUses, userUses := map[string]int{}, map[string]int{}
+	for _, c := range config.Contexts {
+		clusterUses[c.Context.Cluster]++
+		userUses[c.Context.User]++
+	}
+
+	contexts := []kubeconfigContext{}
+	for _, c := range config.Contexts {
+		if !hostClusters[c.Context.Cluster] {
+			continue
+		}
+		if clusterUses[c.Context.Cluster] > 1 {
+			c.Context.Cluster = ""
+		}
+		if userUses[c.Context.User] > 1 {
+			c.Context.User = ""
+		}
+		contexts = append(contexts, c)
+	}
+	return contexts, nil
+}
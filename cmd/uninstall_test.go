@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_uninstallSteps_Server(t *testing.T) {
+	steps := uninstallSteps("server-2", true, true, true, time.Minute, "/opt/rke2")
+
+	got := []string{}
+	for _, step := range steps {
+		where := "node"
+		if step.onServer {
+			where = "server"
+		}
+		got = append(got, where+": "+strings.TrimPrefix(step.command, serverKubectl+" "))
+	}
+
+	want := []string{
+		"server: cordon 'server-2'",
+		"server: drain 'server-2' --ignore-daemonsets --delete-emptydir-data --timeout=1m0s",
+		"server: annotate node 'server-2' " + etcdRemoveAnnotation + " --overwrite",
+		"server: " + strings.TrimPrefix(waitEtcdRemovedCommand("server-2", etcdRemoveTimeout, nodeWaitInterval), serverKubectl+" "),
+		`node: PATH="$PATH:/opt/rke2/bin" rke2-killall.sh`,
+		"server: delete node 'server-2' --ignore-not-found",
+		`node: PATH="$PATH:/opt/rke2/bin" rke2-uninstall.sh`,
+		"node: rm -rf " + strings.Join([]string{rke2ConfigFile, containerdRegistriesFile, rke2JoinConfigFile, rke2NodeConfigFile, rke2ManifestsDir + "/vip.yaml", installScriptPath, airgapArtifactsPath}, " "),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func Test_waitEtcdRemovedCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-uninstall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake kubectl prints the annotation once it has been run twice
+	kubectl := filepath.Join(dir, "kubectl")
+	script := "#!/bin/sh\necho run >> " + dir + "/runs\n[ $(wc -l < " + dir + "/runs) -ge 2 ] && echo server-2\ntrue\n"
+	if err := ioutil.WriteFile(kubectl, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	command := strings.Replace(waitEtcdRemovedCommand("server-2", 2*time.Second, time.Second), serverKubectl, kubectl, 1)
+	if out, err := exec.Command("sh", "-c", command).CombinedOutput(); err != nil {
+		t.Fatalf("want the wait to end once the member was removed, got %s: %s", err, out)
+	}
+
+	// Without the annotation the wait gives up
+	if err := ioutil.WriteFile(kubectl, []byte("#!/bin/sh\ntrue\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	command = strings.Replace(waitEtcdRemovedCommand("server-2", time.Second, time.Second), serverKubectl, kubectl, 1)
+	out, err := exec.Command("sh", "-c", command).CombinedOutput()
+	if err == nil {
+		t.Fatalf("want the wait to time out, got %s", out)
+	}
+	if want := "the etcd member was not removed within 1s"; !strings.Contains(string(out), want) {
+		t.Errorf("want %q, got %q", want, out)
+	}
+}
+
+func Test_uninstallSteps_WithoutServer(t *testing.T) {
+	steps := uninstallSteps("agent-1", false, false, false, time.Minute, "")
+	if len(steps) != 3 {
+		t.Fatalf("want 3 steps, got %+v", steps)
+	}
+	for _, step := range steps {
+		if step.onServer {
+			t.Errorf("want only steps on the node, got %q on the server", step.command)
+		}
+	}
+	if want := `PATH="$PATH:/usr/local/bin" rke2-killall.sh`; steps[0].command != want {
+		t.Errorf("want %q, got %q", want, steps[0].command)
+	}
+}
+
+func Test_hostContexts(t *testing.T) {
+	kubeconfig := `apiVersion: v1
+clusters:
+- cluster:
+    server: https://192.168.0.10:6443
+  name: lab
+- cluster:
+    server: https://192.168.0.20:6443
+  name: prod
+contexts:
+- context:
+    cluster: lab
+    user: lab
+  name: lab
+- context:
+    cluster: lab
+    user: admin
+  name: lab-admin
+- context:
+    cluster: prod
+    user: admin
+  name: prod
+users:
+- name: lab
+- name: admin
+`
+
+	got, err := hostContexts([]byte(kubeconfig), "192.168.0.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []kubeconfigContext{{Name: "lab"}, {Name: "lab-admin"}}
+	want[0].Context.User = "lab"
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
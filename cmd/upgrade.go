@@ -0,0 +1,356 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var upgradeTask = nodeTask{verb: "upgrade", running: "Upgrading", done: "upgraded", stopOnError: true}
+
+func MakeUpgrade() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "upgrade",
+		Short: "Upgrade RKE2 on every node of a cluster, one node at a time",
+		Long: `Upgrade RKE2 on every node of a cluster. Servers are upgraded one at a
+time, then agents. Each node is drained, upgraded and restarted, and must
+be Ready with the new kubelet before it is uncordoned and the next node
+starts. The upgrade stops at the first node which fails. A cluster with
+a single server cannot move its workloads, so that server is cordoned
+but not drained.
+
+` + SupportMsg,
+		Example: `  k2sup upgrade --version v1.24.4+rke2r1 \
+    --server-host SERVER1 --server-host SERVER2 --server-host SERVER3 \
+    --agent-host AGENT1 --agent-host AGENT2
+
+  k2sup upgrade --channel stable --server-host SERVER --hosts-file agents.txt --parallel 3`,
+		SilenceUsage: true,
+	}
+
+	command.Flags().StringArray("server-host", []string{}, "Public hostname of a server, repeat the flag for every server, they are upgraded in the order given")
+	command.Flags().StringArray("agent-host", []string{}, "Public hostname of an agent, repeat the flag for every agent")
+	command.Flags().String("hosts-file", "", "A file listing the hostnames of agents, one per line")
+	command.Flags().Int("parallel", 1, "Number of agents to upgrade at the same time, servers are always upgraded one at a time")
+	command.Flags().String("user", "root", "Username for SSH login")
+
+	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
+
+	addConnectionFlags(command)
+
+	command.Flags().Duration("drain-timeout", 5*time.Minute, "How long to wait for each node to drain")
+	command.Flags().Duration("wait-timeout", 10*time.Minute, "How long to wait for each node to become Ready with the new kubelet")
+
+	command.Flags().String("version", "", "The version to upgrade to, overrides --channel")
+	command.Flags().String("channel", "", "The release channel to upgrade to: stable, latest, or i.e. v1.24")
+	command.Flags().String("install-script-url", defaultInstallScriptURL, "Download the RKE2 install script from this URL on the node, such as an internal mirror")
+	command.Flags().String("install-script-file", "", "Upload this copy of the RKE2 install script rather than downloading it on the node")
+	command.Flags().String("install-script-sha256", "", "The SHA-256 checksum of the install script, which is verified on the node before it is run")
+	command.Flags().String("install-method", installMethodAuto, "How the install script installs RKE2: auto, tar or rpm (auto uses rpm on RHEL-family hosts)")
+	command.Flags().String("install-tar-prefix", "", "Where a tar install puts RKE2, e.g. /opt/rke2 when /usr/local is read-only (Default /usr/local)")
+	command.Flags().String("rpm-repo-url", "", "An https:// mirror of rpm.rancher.io used by the rpm install method")
+	command.Flags().String("airgap-dir", "", "Upgrade without internet access from a directory holding install.sh, the rke2 tarball, its sha256sum file and image tarballs, which are uploaded for the architecture of each node")
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		fmt.Printf("Running: k2sup upgrade\n")
+
+		servers, err := command.Flags().GetStringArray("server-host")
+		if err != nil {
+			return err
+		}
+		if len(servers) == 0 {
+			return fmt.Errorf("give every server with --server-host")
+		}
+		agents, err := command.Flags().GetStringArray("agent-host")
+		if err != nil {
+			return err
+		}
+		hostsFile, err := command.Flags().GetString("hosts-file")
+		if err != nil {
+			return err
+		}
+		if len(hostsFile) > 0 {
+			fileHosts, err := readHostsFile(expandPath(hostsFile))
+			if err != nil {
+				return err
+			}
+			agents = append(agents, fileHosts...)
+		}
+
+		parallel, err := command.Flags().GetInt("parallel")
+		if err != nil {
+			return err
+		}
+		if parallel < 1 {
+			return fmt.Errorf("--parallel must be at least 1")
+		}
+
+		installer, err := makeInstaller(command)
+		if err != nil {
+			return err
+		}
+		printCommand, err := command.Flags().GetBool("print-command")
+		if err != nil {
+			return err
+		}
+		timeout, err := command.Flags().GetDuration("timeout")
+		if err != nil {
+			return err
+		}
+		drainTimeout, err := command.Flags().GetDuration("drain-timeout")
+		if err != nil {
+			return err
+		}
+		waitTimeout, err := command.Flags().GetDuration("wait-timeout")
+		if err != nil {
+			return err
+		}
+		if waitTimeout <= 0 {
+			return fmt.Errorf("give a --wait-timeout greater than zero")
+		}
+		dryRun, err := command.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+		passwords, err := readPasswords(command)
+		if err != nil {
+			return err
+		}
+		become, err := makeBecomeOptions(command, passwords.sudo)
+		if err != nil {
+			return err
+		}
+
+		openSSHConfig, err := loadSSHConfig(command)
+		if err != nil {
+			return err
+		}
+		resolve := func(hosts []string) ([]operator.Target, error) {
+			targets := make([]operator.Target, len(hosts))
+			for i, host := range hosts {
+				if targets[i], err = resolveSSHTarget(command, openSSHConfig, host, []string{"user"}, []string{"ssh-port"}); err != nil {
+					return nil, err
+				}
+			}
+			return targets, nil
+		}
+		serverTargets, err := resolve(servers)
+		if err != nil {
+			return err
+		}
+		agentTargets, err := resolve(agents)
+		if err != nil {
+			return err
+		}
+
+		audit, err := makeAuditOptions(command, serverTargets[0].Host)
+		if err != nil {
+			return err
+		}
+		options := operatorOptions{
+			dryRun: dryRun,
+			become: become,
+			audit:  audit,
+		}
+
+		var connector *operator.Connector
+		if !dryRun {
+			connector, err = makeConnector(command, passwords.ssh)
+			if err != nil {
+				return err
+			}
+			defer connector.Close()
+		}
+
+		ctx := command.Context()
+		upgrader := nodeUpgrader{
+			installer:    installer,
+			drainTimeout: drainTimeout,
+			waitTimeout:  waitTimeout,
+			timeout:      timeout,
+			printCommand: printCommand,
+			dryRun:       dryRun,
+		}
+
+		return upgrader.upgradeCluster(ctx, connector, serverTargets, agentTargets, options, parallel)
+	}
+
+	return command
+}
+
+// nodeUpgrader upgrades one node at a time, running kubectl on a server
+type nodeUpgrader struct {
+	installer    rke2Installer
+	drainTimeout time.Duration
+	waitTimeout  time.Duration
+	timeout      time.Duration
+	printCommand bool
+	dryRun       bool
+}
+
+// upgradeCluster upgrades the servers one at a time, then the agents,
+// starting no more nodes once one has failed
+func (u nodeUpgrader) upgradeCluster(ctx context.Context, connector *operator.Connector, serverTargets, agentTargets []operator.Target, options operatorOptions, parallel int) error {
+	// A single server runs kubectl for its own upgrade, so it is only
+	// cordoned, draining it would evict pods while nothing else can
+	// take over the control plane
+	drainServers := len(serverTargets) > 1
+
+	for i, target := range serverTargets {
+		fmt.Printf("Upgrading server %s (%d/%d)\n", target.Host, i+1, len(serverTargets))
+		if !drainServers {
+			fmt.Printf("%s is the only server, it is upgraded without being drained and the API server is unavailable while it restarts\n", target.Host)
+		}
+
+		// Another server, when there is one, answers kubectl while this
+		// one restarts
+		control := serverTargets[(i+1)%len(serverTargets)]
+		if err := u.upgradeTarget(ctx, connector, target, control, options, true, drainServers); err != nil {
+			return errors.Wrapf(err, "unable to upgrade %s, the remaining nodes were not upgraded", target.Host)
+		}
+	}
+
+	if len(agentTargets) == 0 {
+		return nil
+	}
+
+	controlOperator, err := openOperator(ctx, connector, serverTargets[0], options)
+	if err != nil {
+		return errors.Wrapf(err, "unable to connect to %s", serverTargets[0].Host)
+	}
+	defer controlOperator.Close()
+
+	return runNodes(ctx, connector, agentTargets, options, parallel, upgradeTask, func(nodeOperator operator.Operator, out io.Writer) error {
+		return u.upgrade(ctx, nodeOperator, controlOperator, out, false, true)
+	})
+}
+
+// upgradeTarget connects to target and upgrades it, running kubectl on
+// control
+func (u nodeUpgrader) upgradeTarget(ctx context.Context, connector *operator.Connector, target, control operator.Target, options operatorOptions, server, drain bool) error {
+	nodeOperator, err := openOperator(ctx, connector, target, options)
+	if err != nil {
+		return errors.Wrapf(err, "unable to connect to %s", target.Host)
+	}
+	defer nodeOperator.Close()
+
+	controlOperator, err := openOperator(ctx, connector, control, options)
+	if err != nil {
+		return errors.Wrapf(err, "unable to connect to %s", control.Host)
+	}
+	defer controlOperator.Close()
+
+	return u.upgrade(ctx, nodeOperator, controlOperator, os.Stdout, server, drain)
+}
+
+// upgrade cordons the node, and drains it when drain is set, installs
+// the new version and restarts RKE2, then uncordons the node once it is
+// Ready with the new kubelet. A node which fails is left cordoned.
+func (u nodeUpgrader) upgrade(ctx context.Context, node operator.Operator, control operator.CommandOperator, out io.Writer, server, drain bool) error {
+	name, err := nodeName(ctx, node, "")
+	if err != nil {
+		return err
+	}
+	if u.dryRun && len(name) == 0 {
+		name = dryRunNodeName
+	}
+
+	service, env := "rke2-agent", "INSTALL_RKE2_TYPE='agent'"
+	if server {
+		service, env = "rke2-server", "INSTALL_RKE2_TYPE='server'"
+	}
+
+	if drain {
+		fmt.Fprintf(out, "Draining node %s\n", name)
+	} else {
+		fmt.Fprintf(out, "Cordoning node %s\n", name)
+	}
+	if err := u.runControl(ctx, control, out, kubectl("cordon", operator.ShellQuote(name)), "unable to cordon the node"); err != nil {
+		return err
+	}
+	if drain {
+		if err := u.runControl(ctx, control, out, drainCommand(name, u.drainTimeout), "unable to drain the node"); err != nil {
+			return err
+		}
+	}
+
+	installCommand, err := u.installer.command(ctx, node, out, env)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, createVersionStr(u.installer.version, u.installer.channel, u.installer.method))
+	if u.printCommand {
+		fmt.Fprintf(out, "ssh: %s\n", installCommand)
+	}
+	if res, err := executePhase(ctx, node, u.timeout, installCommand); err != nil {
+		return installFailed(err, res, "unable to install the new version")
+	}
+
+	fmt.Fprintf(out, "Restarting %s\n", service)
+	if err := u.run(ctx, node, out, "systemctl restart "+service, "unable to restart "+service); err != nil {
+		return err
+	}
+
+	version, err := installedVersion(ctx, node, u.installer.method.tarPrefix)
+	if err != nil {
+		return err
+	}
+
+	waiter := nodeWaiter{server: control, timeout: u.waitTimeout, dryRun: u.dryRun}
+	if err := waiter.waitFor(ctx, out, name, version); err != nil {
+		return err
+	}
+
+	return u.runControl(ctx, control, out, kubectl("uncordon", operator.ShellQuote(name)), "unable to uncordon the node")
+}
+
+func (u nodeUpgrader) run(ctx context.Context, node operator.CommandOperator, out io.Writer, command, failure string) error {
+	if u.printCommand {
+		fmt.Fprintf(out, "ssh: %s\n", command)
+	}
+	if res, err := executePhase(ctx, node, u.timeout, command); err != nil {
+		return commandFailed(err, res, failure)
+	}
+	return nil
+}
+
+// runControl runs command on the server, its output is written to out
+// rather than streamed as agents upgraded in parallel share the server
+func (u nodeUpgrader) runControl(ctx context.Context, control operator.CommandOperator, out io.Writer, command, failure string) error {
+	if u.printCommand {
+		fmt.Fprintf(out, "ssh: %s\n", command)
+	}
+	res, err := executePhaseStdio(ctx, control, u.timeout, command, false)
+	out.Write(res.StdOut)
+	if err != nil {
+		return commandFailed(err, res, failure)
+	}
+	return nil
+}
+
+// installedVersion returns the version of RKE2 installed on the node,
+// which is also the version of its kubelet, such as v1.24.4+rke2r1
+func installedVersion(ctx context.Context, node operator.CommandOperator, tarPrefix string) (string, error) {
+	res, err := node.ExecuteStdioContext(ctx, joinWords(rke2BinPath(tarPrefix), "rke2 --version"), false)
+	if err != nil {
+		return "", commandFailed(err, res, "unable to read the installed version of RKE2")
+	}
+	return parseRKE2Version(string(res.StdOut)), nil
+}
+
+// parseRKE2Version reads the version from the output of rke2 --version,
+// which starts "rke2 version v1.24.4+rke2r1 (<commit>)"
+func parseRKE2Version(output string) string {
+	fields := strings.Fields(output)
+	if len(fields) >= 3 && fields[0] == "rke2" && fields[1] == "version" {
+		return fields[2]
+	}
+	return ""
+}
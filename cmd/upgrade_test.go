@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+)
+
+func Test_parseRKE2Version(t *testing.T) {
+	cases := map[string]string{
+		"rke2 version v1.24.4+rke2r1 (b8eec38f8f5b1e38bd50a9bba1a2339e3bda1b47)\ngo version go1.18.1b7\n": "v1.24.4+rke2r1",
+		"sh: rke2: not found\n": "",
+		"":                      "",
+	}
+	for output, want := range cases {
+		if got := parseRKE2Version(output); got != want {
+			t.Errorf("%q: want %q, got %q", output, want, got)
+		}
+	}
+}
+
+func Test_nodeUpgrader_upgradeCluster_Order(t *testing.T) {
+	cluster := &fakeCluster{}
+	if err := cluster.upgrade([]string{"server1", "server2"}, []string{"agent1"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each server runs kubectl for the other, servers before agents
+	want := []string{
+		"server2: cordon server1",
+		"server2: drain server1",
+		"server1: install",
+		"server1: restart rke2-server",
+		"server2: wait server1",
+		"server2: uncordon server1",
+		"server1: cordon server2",
+		"server1: drain server2",
+		"server2: install",
+		"server2: restart rke2-server",
+		"server1: wait server2",
+		"server1: uncordon server2",
+		"server1: cordon agent1",
+		"server1: drain agent1",
+		"agent1: install",
+		"agent1: restart rke2-agent",
+		"server1: wait agent1",
+		"server1: uncordon agent1",
+	}
+	if !reflect.DeepEqual(cluster.steps, want) {
+		t.Errorf("want steps:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(cluster.steps, "\n"))
+	}
+}
+
+func Test_nodeUpgrader_upgradeCluster_StopsAtFailedServer(t *testing.T) {
+	cluster := &fakeCluster{failHost: "server2", failStep: "restart rke2-server"}
+	err := cluster.upgrade([]string{"server1", "server2", "server3"}, []string{"agent1"}, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "unable to upgrade server2, the remaining nodes were not upgraded") {
+		t.Fatalf("want the failed server named, got %v", err)
+	}
+
+	want := []string{
+		"server3: cordon server2",
+		"server3: drain server2",
+		"server2: install",
+		"server2: restart rke2-server",
+	}
+	if got := cluster.ran("server2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("want server2 left cordoned after %v, got %v", want, got)
+	}
+	for _, node := range []string{"server3", "agent1"} {
+		if got := cluster.ran(node); len(got) > 0 {
+			t.Errorf("want %s not started after a failure, got %v", node, got)
+		}
+	}
+}
+
+func Test_nodeUpgrader_upgradeCluster_StopsAtFailedAgent(t *testing.T) {
+	cluster := &fakeCluster{failHost: "agent", failStep: "install"}
+	err := cluster.upgrade([]string{"server1", "server2"}, []string{"agent1", "agent2"}, time.Minute)
+	if err == nil || err.Error() != "2 of 2 nodes failed to upgrade" {
+		t.Fatalf("want the failed and the skipped agent counted, got %v", err)
+	}
+
+	started := 0
+	for _, node := range []string{"agent1", "agent2"} {
+		steps := cluster.ran(node)
+		if len(steps) == 0 {
+			continue
+		}
+		started++
+		if last := steps[len(steps)-1]; last != node+": install" {
+			t.Errorf("want %s left cordoned after the install failed, got %v", node, steps)
+		}
+	}
+	if started != 1 {
+		t.Errorf("want one agent started, got %d", started)
+	}
+}
+
+func Test_nodeUpgrader_upgradeCluster_WaitsForKubelet(t *testing.T) {
+	cluster := &fakeCluster{stale: "server1"}
+	err := cluster.upgrade([]string{"server1", "server2"}, nil, 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "node runs kubelet "+testOldKubelet+", not "+testNewKubelet+" yet") {
+		t.Fatalf("want the upgrade to wait for the new kubelet, got %v", err)
+	}
+	for _, step := range cluster.steps {
+		if strings.Contains(step, "uncordon") || strings.HasPrefix(step, "server1: cordon") {
+			t.Errorf("want nothing after the wait for server1, got %q", step)
+		}
+	}
+}
+
+func Test_nodeUpgrader_upgradeCluster_SingleServer(t *testing.T) {
+	cluster := &fakeCluster{}
+	if err := cluster.upgrade([]string{"server1"}, []string{"agent1"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// The only server is not drained, agents still are
+	want := []string{
+		"server1: cordon server1",
+		"server1: install",
+		"server1: restart rke2-server",
+		"server1: wait server1",
+		"server1: uncordon server1",
+		"server1: cordon agent1",
+		"server1: drain agent1",
+		"agent1: install",
+		"agent1: restart rke2-agent",
+		"server1: wait agent1",
+		"server1: uncordon agent1",
+	}
+	if !reflect.DeepEqual(cluster.steps, want) {
+		t.Errorf("want steps:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(cluster.steps, "\n"))
+	}
+}
+
+const (
+	testOldKubelet = "v1.24.4+rke2r1"
+	testNewKubelet = "v1.25.3+rke2r1"
+)
+
+// fakeCluster answers the commands run by an upgrade on every node, and
+// records each step as "<host the step ran on>: <step>"
+type fakeCluster struct {
+	mu    sync.Mutex
+	steps []string
+
+	// failStep fails on the first host starting with failHost
+	failHost, failStep string
+	failed             bool
+	// stale names a node which keeps running the old kubelet
+	stale string
+}
+
+func (c *fakeCluster) connect(ctx context.Context, target operator.Target) (operator.Operator, error) {
+	return fakeNode{cluster: c, host: target.Host}, nil
+}
+
+// upgrade upgrades servers and agents with the fake cluster
+func (c *fakeCluster) upgrade(servers, agents []string, waitTimeout time.Duration) error {
+	targets := func(hosts []string) []operator.Target {
+		t := []operator.Target{}
+		for _, host := range hosts {
+			t = append(t, operator.Target{Host: host})
+		}
+		return t
+	}
+	upgrader := nodeUpgrader{
+		installer:    rke2Installer{version: testNewKubelet, scriptURL: defaultInstallScriptURL},
+		drainTimeout: time.Minute,
+		waitTimeout:  waitTimeout,
+	}
+	return upgrader.upgradeCluster(context.Background(), nil, targets(servers), targets(agents), operatorOptions{connect: c.connect}, 1)
+}
+
+// ran returns the steps which upgrade node, kubectl steps name the node
+// and the others run on it
+func (c *fakeCluster) ran(node string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	steps := []string{}
+	for _, step := range c.steps {
+		if strings.HasSuffix(step, " "+node) || step == node+": install" || strings.HasPrefix(step, node+": restart ") {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+type fakeNode struct {
+	cluster *fakeCluster
+	host    string
+}
+
+func (n fakeNode) Execute(command string) (operator.CommandRes, error) {
+	return n.ExecuteStdioContext(context.Background(), command, true)
+}
+
+func (n fakeNode) ExecuteStdio(command string, stream bool) (operator.CommandRes, error) {
+	return n.ExecuteStdioContext(context.Background(), command, stream)
+}
+
+func (n fakeNode) ExecuteContext(ctx context.Context, command string) (operator.CommandRes, error) {
+	return n.ExecuteStdioContext(ctx, command, true)
+}
+
+func (n fakeNode) ExecuteStdioContext(ctx context.Context, command string, stream bool) (operator.CommandRes, error) {
+	step, stdout := "", ""
+	switch fields := strings.Fields(command); {
+	case command == "hostname":
+		stdout = n.host
+	case strings.Contains(command, "rke2 --version"):
+		stdout = "rke2 version " + testNewKubelet + " (abc)\n"
+	case strings.HasPrefix(command, serverKubectl+" get node "):
+		name := strings.Trim(fields[5], "'")
+		step = "wait " + name
+		stdout = testNewKubelet + "\tTrue\t"
+		if name == n.cluster.stale {
+			stdout = testOldKubelet + "\tTrue\t"
+		}
+	case strings.HasPrefix(command, serverKubectl+" get pods "):
+		stdout = "kube-proxy\tRunning\ttrue\n"
+	case strings.HasPrefix(command, serverKubectl+" "):
+		// cordon, drain or uncordon and the node name
+		step = fields[3] + " " + strings.Trim(fields[4], "'")
+	case strings.Contains(command, "INSTALL_RKE2_TYPE"):
+		step = "install"
+	case strings.HasPrefix(command, "systemctl restart "):
+		step = "restart " + fields[2]
+	}
+
+	n.cluster.mu.Lock()
+	defer n.cluster.mu.Unlock()
+	if len(step) == 0 {
+		return operator.CommandRes{StdOut: []byte(stdout)}, nil
+	}
+	n.cluster.steps = append(n.cluster.steps, n.host+": "+step)
+	if !n.cluster.failed && step == n.cluster.failStep && strings.HasPrefix(n.host, n.cluster.failHost) {
+		n.cluster.failed = true
+		return operator.CommandRes{StdErr: []byte("failed\n"), ExitCode: 1}, fmt.Errorf("Process exited with status 1")
+	}
+	return operator.CommandRes{StdOut: []byte(stdout)}, nil
+}
+
+func (n fakeNode) Upload(source io.Reader, target string, mode os.FileMode, owner string) error {
+	return nil
+}
+
+func (n fakeNode) Close() error {
+	return nil
+}
@@ -0,0 +1,256 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// serverKubectl runs kubectl on a server with the admin kubeconfig
+// written by RKE2
+const serverKubectl = "/var/lib/rancher/rke2/bin/kubectl --kubeconfig " + rke2ConfigPath + "rke2.yaml"
+
+// kubectl returns a command running serverKubectl with args
+func kubectl(args ...string) string {
+	return joinWords(append([]string{serverKubectl}, args...)...)
+}
+
+// nodeWaitInterval is how long to wait between checks of a node
+const nodeWaitInterval = 5 * time.Second
+
+// dryRunNodeName stands in for the name of a node, which is not read in a
+// dry run
+const dryRunNodeName = "<node-name>"
+
+// nodeWaiter polls a server until nodes are Ready and the kube-system pods
+// scheduled on them are running
+type nodeWaiter struct {
+	server  operator.CommandOperator
+	timeout time.Duration
+	dryRun  bool
+}
+
+// makeWaitTimeout reads --wait and --wait-timeout, the timeout is zero
+// when nodes should not be waited for
+func makeWaitTimeout(command *cobra.Command) (time.Duration, error) {
+	wait, err := command.Flags().GetBool("wait")
+	if err != nil {
+		return 0, err
+	}
+	timeout, err := command.Flags().GetDuration("wait-timeout")
+	if err != nil {
+		return 0, err
+	}
+	if !wait {
+		return 0, nil
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("give a --wait-timeout greater than zero")
+	}
+	return timeout, nil
+}
+
+// wait blocks until the node reached through node is Ready, configFile
+// is the RKE2 config uploaded to it, which may set node-name
+func (w nodeWaiter) wait(ctx context.Context, node operator.CommandOperator, out io.Writer, configFile string) error {
+	name, err := nodeName(ctx, node, configFile)
+	if err != nil {
+		return err
+	}
+	if w.dryRun && len(name) == 0 {
+		name = dryRunNodeName
+	}
+	return w.waitFor(ctx, out, name, "")
+}
+
+// waitFor blocks until the node called name is Ready, and runs a kubelet
+// of kubeletVersion when it is given
+func (w nodeWaiter) waitFor(ctx context.Context, out io.Writer, name, kubeletVersion string) error {
+	fmt.Fprintf(out, "Waiting up to %s for node %s to become Ready...\n", w.timeout, name)
+
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	blocking := "it was not checked"
+	for {
+		current, err := w.check(ctx, name, kubeletVersion)
+		if err != nil {
+			return err
+		}
+		if w.dryRun {
+			return nil
+		}
+		// A check cut short by the timeout says nothing about the node
+		if ctx.Err() == nil {
+			if len(current) == 0 {
+				fmt.Fprintf(out, "Node %s is Ready\n", name)
+				return nil
+			}
+			blocking = current
+		}
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("timed out after %s waiting for node %s, %s", w.timeout, name, blocking)
+			}
+			return ctx.Err()
+		case <-time.After(nodeWaitInterval):
+		}
+	}
+}
+
+// check returns what stops the node from being Ready, or an empty string
+// once it and its kube-system pods are ready. Failed commands are only
+// reported, as the API server may still be starting.
+func (w nodeWaiter) check(ctx context.Context, name, kubeletVersion string) (string, error) {
+	res, err := w.server.ExecuteStdioContext(ctx, nodeReadyCommand(name), false)
+	if blocking, err := checkFailed(ctx, res, err); len(blocking) > 0 || err != nil {
+		return "node " + blocking, err
+	}
+	if blocking := nodeReadiness(string(res.StdOut), kubeletVersion); len(blocking) > 0 {
+		return blocking, nil
+	}
+
+	res, err = w.server.ExecuteStdioContext(ctx, systemPodsCommand(name), false)
+	if blocking, err := checkFailed(ctx, res, err); len(blocking) > 0 || err != nil {
+		return "kube-system pods " + blocking, err
+	}
+	return systemPodsReadiness(string(res.StdOut)), nil
+}
+
+// checkFailed describes a failed kubectl command, the error is only
+// returned when it means the wait has to stop
+func checkFailed(ctx context.Context, res operator.CommandRes, err error) (string, error) {
+	if err == nil {
+		return "", nil
+	}
+	if err == operator.ErrPasswordRequired || err == operator.ErrPasswordIncorrect {
+		return "", explainBecome(err)
+	}
+	if ctx.Err() == context.Canceled {
+		return "", ctx.Err()
+	}
+	if stderr := strings.TrimSpace(res.StdErrTail(1)); len(stderr) > 0 {
+		return "unavailable: " + stderr, nil
+	}
+	return "unavailable: " + err.Error(), nil
+}
+
+func nodeReadyCommand(name string) string {
+	return fmt.Sprintf(`%s get node %s -o jsonpath='{.status.nodeInfo.kubeletVersion}{"\t"}{range .status.conditions[?(@.type=="Ready")]}{.status}{"\t"}{.message}{end}'`,
+		serverKubectl, operator.ShellQuote(name))
+}
+
+func systemPodsCommand(name string) string {
+	return fmt.Sprintf(`%s get pods -n kube-system --field-selector %s -o jsonpath='{range .items[*]}{.metadata.name}{"\t"}{.status.phase}{"\t"}{.status.containerStatuses[*].ready}{"\n"}{end}'`,
+		serverKubectl, operator.ShellQuote("spec.nodeName="+name))
+}
+
+// nodeReadiness parses the output of nodeReadyCommand, which is the
+// kubelet version followed by the status and message of the Ready
+// condition
+func nodeReadiness(output, kubeletVersion string) string {
+	fields := strings.SplitN(strings.TrimSpace(output), "\t", 3)
+	for len(fields) < 3 {
+		fields = append(fields, "")
+	}
+
+	version, status, message := fields[0], fields[1], fields[2]
+	switch {
+	case len(status) == 0:
+		return "node has no Ready condition yet"
+	case status != "True" && len(message) > 0:
+		return "node is not Ready: " + message
+	case status != "True":
+		return "node is not Ready"
+	case len(kubeletVersion) > 0 && version != kubeletVersion:
+		return fmt.Sprintf("node runs kubelet %s, not %s yet", version, kubeletVersion)
+	}
+	return ""
+}
+
+// systemPodsReadiness parses the output of systemPodsCommand, one line of
+// name, phase and container readiness per pod, and lists the pods which
+// are not running yet
+func systemPodsReadiness(output string) string {
+	pending := []string{}
+	pods := 0
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields[0]) == 0 {
+			continue
+		}
+		pods++
+
+		phase, ready := "", ""
+		if len(fields) > 1 {
+			phase = fields[1]
+		}
+		if len(fields) > 2 {
+			ready = fields[2]
+		}
+
+		switch {
+		case phase == "Succeeded":
+		case phase == "Running" && len(ready) > 0 && !strings.Contains(ready, "false"):
+		case phase == "Running":
+			pending = append(pending, fields[0]+" (containers not ready)")
+		default:
+			pending = append(pending, fmt.Sprintf("%s (%s)", fields[0], strings.ToLower(firstString(phase, "Unknown"))))
+		}
+	}
+
+	if pods == 0 {
+		return "no kube-system pods have started on the node yet"
+	}
+	if len(pending) > 0 {
+		return "kube-system pods are not running: " + strings.Join(pending, ", ")
+	}
+	return ""
+}
+
+// nodeName returns the name the node registers with, which is node-name
+// from configFile, or from the RKE2 config on the node, or else its
+// hostname
+func nodeName(ctx context.Context, node operator.CommandOperator, configFile string) (string, error) {
+	if len(configFile) > 0 {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return "", errors.Wrapf(err, "unable to read config file %q", configFile)
+		}
+		config := struct {
+			NodeName string `yaml:"node-name"`
+		}{}
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return "", errors.Wrapf(err, "unable to parse config file %q", configFile)
+		}
+		if len(config.NodeName) > 0 {
+			return config.NodeName, nil
+		}
+	}
+
+	// Only node-name is read, the config holds the join token
+	res, err := node.ExecuteStdioContext(ctx, "sed -n 's/^node-name: *//p' "+rke2ConfigFile+" 2>/dev/null || true", false)
+	if err != nil {
+		return "", commandFailed(err, res, "unable to read the node name from "+rke2ConfigFile)
+	}
+	if name := strings.Trim(strings.TrimSpace(string(res.StdOut)), `"'`); len(name) > 0 {
+		return name, nil
+	}
+
+	res, err = node.ExecuteStdioContext(ctx, "hostname", false)
+	if err != nil {
+		return "", commandFailed(err, res, "unable to read the hostname of the node")
+	}
+	// Kubernetes node names are lower case, RKE2 lowers the hostname
+	return strings.ToLower(strings.TrimSpace(string(res.StdOut))), nil
+}
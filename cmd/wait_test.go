@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+)
+
+func Test_nodeReadiness(t *testing.T) {
+	cases := map[string]string{
+		"v1.24.4+rke2r1\tTrue\tkubelet is posting ready status":                                  "",
+		"v1.24.4+rke2r1\tFalse\tcontainer runtime network not ready: cni plugin not initialized": "node is not Ready: container runtime network not ready: cni plugin not initialized",
+		"v1.24.4+rke2r1\tUnknown\t":                                                              "node is not Ready",
+		"v1.24.4+rke2r1\t":                                                                       "node has no Ready condition yet",
+		"":                                                                                       "node has no Ready condition yet",
+	}
+	for output, want := range cases {
+		if got := nodeReadiness(output, ""); got != want {
+			t.Errorf("%q: want %q, got %q", output, want, got)
+		}
+	}
+}
+
+func Test_nodeReadiness_KubeletVersion(t *testing.T) {
+	if got := nodeReadiness("v1.24.4+rke2r1\tTrue\t", "v1.24.4+rke2r1"); got != "" {
+		t.Errorf("want the node ready, got %q", got)
+	}
+
+	want := "node runs kubelet v1.23.9+rke2r1, not v1.24.4+rke2r1 yet"
+	if got := nodeReadiness("v1.23.9+rke2r1\tTrue\t", "v1.24.4+rke2r1"); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func Test_systemPodsReadiness(t *testing.T) {
+	cases := map[string]string{
+		"kube-proxy-node1\tRunning\ttrue\nrke2-canal-x2b9f\tRunning\ttrue true\nhelm-install-rke2-canal-qjx7c\tSucceeded\tfalse\n": "",
+		"kube-proxy-node1\tRunning\ttrue\nrke2-canal-x2b9f\tRunning\ttrue false\n":                                                 "kube-system pods are not running: rke2-canal-x2b9f (containers not ready)",
+		"kube-proxy-node1\tPending\t\n": "kube-system pods are not running: kube-proxy-node1 (pending)",
+		"":                              "no kube-system pods have started on the node yet",
+	}
+	for output, want := range cases {
+		if got := systemPodsReadiness(output); got != want {
+			t.Errorf("%q: want %q, got %q", output, want, got)
+		}
+	}
+}
+
+func Test_nodeName_FromConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "k2sup-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("node-name: worker-1\nnode-label:\n  - role=worker\n")
+	f.Close()
+
+	op := operator.NewDryRunOperator("node0")
+	op.Out = ioutil.Discard
+	got, err := nodeName(context.Background(), op, f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "worker-1" {
+		t.Errorf("want worker-1, got %q", got)
+	}
+	if len(op.Records) != 0 {
+		t.Errorf("want no commands run, got %+v", op.Records)
+	}
+}
+
+func Test_nodeWaiter_DryRun(t *testing.T) {
+	server := operator.NewDryRunOperator("server0")
+	server.Out = ioutil.Discard
+	node := operator.NewDryRunOperator("node0")
+	node.Out = ioutil.Discard
+
+	waiter := nodeWaiter{server: server, timeout: time.Minute, dryRun: true}
+	if err := waiter.wait(context.Background(), node, ioutil.Discard, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(server.Records) != 1 || !strings.Contains(server.Records[0].Command, "get node '"+dryRunNodeName+"'") {
+		t.Errorf("want the node checked once on the server, got %+v", server.Records)
+	}
+}
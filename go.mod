@@ -4,12 +4,12 @@ go 1.15
 
 require (
 	github.com/alexellis/go-execute v0.0.0-20200124154445-8697e4e28c5e
-	github.com/bramvdbogaerde/go-scp v1.1.0
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/morikuni/aec v1.0.0
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.0.0
-	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/thanhpk/randstr v1.0.4
+	github.com/spf13/pflag v1.0.5
 	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
+	golang.org/x/sys v0.0.0-20210525143221-35b2ab0089ea // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
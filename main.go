@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/alexellis/k3sup/cmd"
 	"github.com/spf13/cobra"
@@ -13,6 +17,9 @@ func main() {
 	cmdVersion := cmd.MakeVersion()
 	cmdJoin := cmd.MakeJoin()
 	cmdUpdate := cmd.MakeUpdate()
+	cmdApply := cmd.MakeApply()
+	cmdUninstall := cmd.MakeUninstall()
+	cmdUpgrade := cmd.MakeUpgrade()
 
 	printk3supASCIIArt := cmd.PrintK3supASCIIArt
 
@@ -28,8 +35,23 @@ func main() {
 	rootCmd.AddCommand(cmdVersion)
 	rootCmd.AddCommand(cmdJoin)
 	rootCmd.AddCommand(cmdUpdate)
-
-	if err := rootCmd.Execute(); err != nil {
+	rootCmd.AddCommand(cmdApply)
+	rootCmd.AddCommand(cmdUninstall)
+	rootCmd.AddCommand(cmdUpgrade)
+
+	// Cancel remote commands on the first Ctrl-C, a second one exits
+	// straight away
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Fprintln(os.Stderr, "Interrupted, stopping remote commands...")
+		signal.Stop(signals)
+		cancel()
+	}()
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,164 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditOperator runs commands and uploads with the Operator it wraps and
+// writes a transcript of each one, with secrets redacted, to a log file
+type AuditOperator struct {
+	Operator
+
+	mu      sync.Mutex
+	log     io.WriteCloser
+	secrets []string
+}
+
+// NewAuditOperator wraps op to append a transcript to the file at path,
+// which is created along with its directory so that only the current
+// user can read it. Secrets are redacted along with anything matched by
+// Redact.
+func NewAuditOperator(op Operator, path string, secrets []string) (*AuditOperator, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create the log directory: %s", err)
+	}
+
+	log, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the log: %s", err)
+	}
+
+	return &AuditOperator{
+		Operator: op,
+		log:      log,
+		secrets:  secrets,
+	}, nil
+}
+
+func (a *AuditOperator) Execute(command string) (CommandRes, error) {
+	return a.ExecuteStdioContext(context.Background(), command, true)
+}
+
+func (a *AuditOperator) ExecuteStdio(command string, stream bool) (CommandRes, error) {
+	return a.ExecuteStdioContext(context.Background(), command, stream)
+}
+
+func (a *AuditOperator) ExecuteContext(ctx context.Context, command string) (CommandRes, error) {
+	return a.ExecuteStdioContext(ctx, command, true)
+}
+
+// ExecuteStdioContext runs command and records it along with its exit
+// code, duration and output
+func (a *AuditOperator) ExecuteStdioContext(ctx context.Context, command string, stream bool) (CommandRes, error) {
+	return a.execute(ctx, command, stream, false)
+}
+
+// ExecuteSecret runs command without streaming its output, which is a
+// secret such as the join token. Each line of the output is redacted
+// from this entry and from every later one.
+func (a *AuditOperator) ExecuteSecret(ctx context.Context, command string) (CommandRes, error) {
+	return a.execute(ctx, command, false, true)
+}
+
+func (a *AuditOperator) execute(ctx context.Context, command string, stream, secret bool) (CommandRes, error) {
+	start := time.Now()
+	res, err := a.Operator.ExecuteStdioContext(ctx, command, stream)
+
+	if secret {
+		a.mu.Lock()
+		for _, line := range strings.Split(string(res.StdOut), "\n") {
+			if line = strings.TrimSpace(line); len(line) > 0 {
+				a.secrets = append(a.secrets, line)
+			}
+		}
+		a.mu.Unlock()
+	}
+
+	entry := strings.Builder{}
+	fmt.Fprintf(&entry, "=== %s\n$ %s\n", start.UTC().Format(time.RFC3339), strings.TrimSpace(command))
+	fmt.Fprintf(&entry, "exit code: %d, duration: %s\n", res.ExitCode, res.Duration.Round(time.Millisecond))
+	if err != nil {
+		fmt.Fprintf(&entry, "error: %s\n", err)
+	}
+	writeSection(&entry, "stdout", res.StdOut)
+	writeSection(&entry, "stderr", res.StdErr)
+
+	a.write(entry.String())
+	return res, err
+}
+
+// Upload writes the file and records its target, mode, owner and size,
+// the contents are not recorded
+func (a *AuditOperator) Upload(source io.Reader, target string, mode os.FileMode, owner string) error {
+	start := time.Now()
+	counter := &countingReader{r: source}
+	err := a.Operator.Upload(counter, target, mode, owner)
+
+	entry := strings.Builder{}
+	fmt.Fprintf(&entry, "=== %s\nupload %s (mode %04o", start.UTC().Format(time.RFC3339), target, mode.Perm())
+	if len(owner) > 0 {
+		fmt.Fprintf(&entry, ", owner %s", owner)
+	}
+	fmt.Fprintf(&entry, ", %d bytes), duration: %s\n", counter.n, time.Since(start).Round(time.Millisecond))
+	if err != nil {
+		fmt.Fprintf(&entry, "error: %s\n", err)
+	}
+
+	a.write(entry.String())
+	return err
+}
+
+// ExecuteSecret runs command on op without streaming its output, which
+// is a secret that is never written to an audit log
+func ExecuteSecret(ctx context.Context, op CommandOperator, command string) (CommandRes, error) {
+	if auditOperator, ok := op.(*AuditOperator); ok {
+		return auditOperator.ExecuteSecret(ctx, command)
+	}
+	return op.ExecuteStdioContext(ctx, command, false)
+}
+
+// Close closes the log and the wrapped operator
+func (a *AuditOperator) Close() error {
+	a.mu.Lock()
+	a.log.Close()
+	a.mu.Unlock()
+
+	return a.Operator.Close()
+}
+
+func (a *AuditOperator) write(entry string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// A failure to write the log is not allowed to fail the install
+	io.WriteString(a.log, Redact(entry, a.secrets))
+}
+
+func writeSection(entry *strings.Builder, name string, output []byte) {
+	if len(output) == 0 {
+		return
+	}
+	fmt.Fprintf(entry, "--- %s\n%s", name, output)
+	if output[len(output)-1] != '\n' {
+		entry.WriteString("\n")
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,100 @@
+package ssh
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_AuditOperator_WritesRedactedTranscript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cluster", "node1.log")
+	op, err := NewAuditOperator(&DryRunOperator{Host: "node1", Out: ioutil.Discard}, path, []string{"hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := op.ExecuteStdio("echo hunter2 | passwd --stdin", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := op.Upload(strings.NewReader("token: abc\n"), "/etc/rancher/rke2/config.yaml", 0600, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := op.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("want the log readable only by its owner, got %s", info.Mode())
+	}
+
+	transcript, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"$ echo <redacted> | passwd --stdin\nexit code: 0, duration: 0s\n",
+		"upload /etc/rancher/rke2/config.yaml (mode 0600, 11 bytes)",
+	} {
+		if !strings.Contains(string(transcript), want) {
+			t.Errorf("want %q in the transcript:\n%s", want, transcript)
+		}
+	}
+	if strings.Contains(string(transcript), "hunter2") {
+		t.Errorf("want secrets redacted:\n%s", transcript)
+	}
+}
+
+func Test_AuditOperator_ExecuteSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A token which the join token pattern does not match, such as one
+	// given in the server config
+	token := "my-cluster-secret"
+	path := filepath.Join(dir, "cluster", "node1.log")
+	op, err := NewAuditOperator(&ExecOperator{}, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ExecuteSecret(context.Background(), op, "echo "+token+" | tr -d -")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(res.StdOut)); got != "myclustersecret" {
+		t.Errorf("want the secret returned, got %q", got)
+	}
+	if _, err := op.ExecuteStdio("echo joining with myclustersecret", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := op.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	transcript, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(transcript), "myclustersecret") {
+		t.Errorf("want the output of the secret command redacted everywhere:\n%s", transcript)
+	}
+	if !strings.Contains(string(transcript), "--- stdout\n"+Redacted+"\n") {
+		t.Errorf("want the output recorded as redacted:\n%s", transcript)
+	}
+}
@@ -0,0 +1,388 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// usedPassword is recorded as the identity when a password was sent
+const usedPassword = "password"
+
+// DefaultKeyNames are the private keys in ~/.ssh which are tried when
+// no key is given, in the same order as OpenSSH
+var DefaultKeyNames = []string{"id_rsa", "id_ecdsa", "id_ed25519", "id_dsa"}
+
+// DefaultKeyPaths returns the paths of the default private keys which
+// exist in ~/.ssh
+func DefaultKeyPaths() []string {
+	paths := []string{}
+	for _, name := range DefaultKeyNames {
+		path := expandTilde(filepath.Join("~", ".ssh", name))
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// identitySigner records the name of the key each time it signs. The
+// server is only sent a signature for a key it has already accepted, so
+// once the connection succeeds the last name recorded is the key which
+// authenticated.
+type identitySigner struct {
+	ssh.Signer
+	name string
+	used *string
+}
+
+func (s *identitySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	*s.used = s.name
+	return s.Signer.Sign(rand, data)
+}
+
+// identityAlgorithmSigner keeps the ssh.AlgorithmSigner interface of
+// the wrapped signer, needed for rsa-sha2 signatures
+type identityAlgorithmSigner struct {
+	*identitySigner
+	algorithmSigner ssh.AlgorithmSigner
+}
+
+func (s identityAlgorithmSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	*s.used = s.name
+	return s.algorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+func recordIdentity(signer ssh.Signer, name string, used *string) ssh.Signer {
+	base := &identitySigner{Signer: signer, name: name, used: used}
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok {
+		return identityAlgorithmSigner{identitySigner: base, algorithmSigner: algorithmSigner}
+	}
+	return base
+}
+
+// agentSigners returns every identity held by the SSH agent, the agent
+// connection must be closed once authentication has completed
+func agentSigners(used *string) ([]ssh.Signer, func() error, error) {
+	sshAgentConn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sshAgent := agent.NewClient(sshAgentConn)
+
+	keys, err := sshAgent.List()
+	if err != nil {
+		sshAgentConn.Close()
+		return nil, nil, err
+	}
+	signers, err := sshAgent.Signers()
+	if err != nil {
+		sshAgentConn.Close()
+		return nil, nil, err
+	}
+
+	comments := map[string]string{}
+	for _, key := range keys {
+		comments[string(key.Blob)] = key.Comment
+	}
+
+	for i, signer := range signers {
+		name := "agent key " + comments[string(signer.PublicKey().Marshal())]
+		signers[i] = recordIdentity(signer, strings.TrimSpace(name), used)
+	}
+
+	return signers, sshAgentConn.Close, nil
+}
+
+// sshAgent returns the agent's signer for the public key at
+// publicKeyPath, if the agent holds it
+func sshAgent(publicKeyPath string) (ssh.Signer, func() error) {
+	if sshAgentConn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
+		sshAgent := agent.NewClient(sshAgentConn)
+
+		signers, _ := sshAgent.Signers()
+		if len(signers) == 0 {
+			return nil, sshAgentConn.Close
+		}
+
+		pubkey, err := ioutil.ReadFile(publicKeyPath)
+		if err != nil {
+			return nil, sshAgentConn.Close
+		}
+
+		authkey, _, _, _, err := ssh.ParseAuthorizedKey(pubkey)
+		if err != nil {
+			return nil, sshAgentConn.Close
+		}
+		parsedkey := authkey.Marshal()
+
+		for _, signer := range signers {
+			if bytes.Equal(signer.PublicKey().Marshal(), parsedkey) {
+				return signer, sshAgentConn.Close
+			}
+		}
+	}
+	return nil, func() error { return nil }
+}
+
+// encryptedSigner defers asking for the passphrase of an encrypted key
+// until the server has accepted its public key, so that only the key
+// which is actually used is prompted for
+type encryptedSigner struct {
+	path string
+	key  []byte
+	pub  ssh.PublicKey
+	keys *decryptedKeys
+}
+
+func (s *encryptedSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *encryptedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := s.keys.signer(s.path, s.key)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(rand, data)
+}
+
+// decryptedKeys holds the keys decrypted with a passphrase, so that each
+// is asked for once however many hosts are connected to. The prompts are
+// made one at a time, as they share the terminal.
+type decryptedKeys struct {
+	mu      sync.Mutex
+	signers map[string]ssh.Signer
+
+	// prompt asks for the passphrase of the key read from path
+	prompt func(path string, key []byte) (ssh.Signer, error)
+}
+
+func newDecryptedKeys() *decryptedKeys {
+	return &decryptedKeys{
+		signers: map[string]ssh.Signer{},
+		prompt:  promptPassphrase,
+	}
+}
+
+// signer returns the key at path, asking for its passphrase unless it was
+// already decrypted. A passphrase which was rejected is asked for again
+// next time.
+func (d *decryptedKeys) signer(path string, key []byte) (ssh.Signer, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if signer, ok := d.signers[path]; ok {
+		return signer, nil
+	}
+
+	signer, err := d.prompt(path, key)
+	if err != nil {
+		return nil, err
+	}
+	d.signers[path] = signer
+	return signer, nil
+}
+
+// decrypted returns the key at path if it was already decrypted
+func (d *decryptedKeys) decrypted(path string) (ssh.Signer, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	signer, ok := d.signers[path]
+	return signer, ok
+}
+
+func promptPassphrase(path string, key []byte) (ssh.Signer, error) {
+	fmt.Printf("Enter passphrase for '%s': ", path)
+	STDIN := int(os.Stdin.Fd())
+	bytePassword, _ := terminal.ReadPassword(STDIN)
+
+	// Ignore any error from reading stdin to retain existing behaviour for unit test in
+	// auth_test.go
+
+	fmt.Println()
+
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(key, bytePassword)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key with passphrase failed: %s", err)
+	}
+	return signer, nil
+}
+
+// loadPublickey loads the private key at path and returns its signers,
+// with a certificate first when one is found. When certPath is empty a
+// certificate is looked for beside the key as <path>-cert.pub. Encrypted
+// keys are decrypted through keys.
+func loadPublickey(path, certPath string, keys *decryptedKeys) ([]ssh.Signer, func() error, error) {
+	noopCloseFunc := func() error { return nil }
+
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, noopCloseFunc, fmt.Errorf("unable to read file: %s, %s", path, err)
+	}
+
+	closeSSHAgent := noopCloseFunc
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+			return nil, noopCloseFunc, fmt.Errorf("unable to parse private key: %s", err.Error())
+		}
+
+		var agentSigner ssh.Signer
+		if decrypted, ok := keys.decrypted(path); ok {
+			signer = decrypted
+		} else if agentSigner, closeSSHAgent = sshAgent(path + ".pub"); agentSigner != nil {
+			signer = agentSigner
+		} else if pub, err := readPublicKey(path); err == nil {
+			signer = &encryptedSigner{path: path, key: key, pub: pub, keys: keys}
+		} else {
+			closeSSHAgent()
+			closeSSHAgent = noopCloseFunc
+
+			if signer, err = keys.signer(path, key); err != nil {
+				return nil, noopCloseFunc, err
+			}
+		}
+	}
+
+	if len(certPath) == 0 {
+		if _, err := os.Stat(path + "-cert.pub"); err == nil {
+			certPath = path + "-cert.pub"
+		}
+	}
+
+	if len(certPath) > 0 {
+		certSigner, err := loadCertSigner(certPath, signer)
+		if err != nil {
+			closeSSHAgent()
+			return nil, noopCloseFunc, err
+		}
+		// Offer the certificate first, then the bare key, as OpenSSH does
+		return []ssh.Signer{certSigner, signer}, closeSSHAgent, nil
+	}
+
+	return []ssh.Signer{signer}, closeSSHAgent, nil
+}
+
+// loadCertSigner reads an OpenSSH user certificate and wraps signer so
+// that the certificate is presented when authenticating
+func loadCertSigner(certPath string, signer ssh.Signer) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate: %s, %s", certPath, err)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse certificate %s: %s", certPath, err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is a public key, not a certificate", certPath)
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use certificate %s: %s", certPath, err)
+	}
+
+	return certSigner, nil
+}
+
+// passwordAuth returns password and keyboard-interactive auth methods
+// for the configured password, used is set when the server asked for
+// the password
+func (c *Connector) passwordAuth(used *string) []ssh.AuthMethod {
+	if len(c.auth.Password) == 0 {
+		return nil
+	}
+
+	return []ssh.AuthMethod{
+		ssh.PasswordCallback(func() (string, error) {
+			*used = usedPassword
+			return c.auth.Password, nil
+		}),
+		ssh.KeyboardInteractive(passwordChallenge(c.auth.Password, used)),
+	}
+}
+
+// passwordChallenge answers the keyboard-interactive questions which ask
+// for a password, any other question such as a one-time code is answered
+// with an empty string
+func passwordChallenge(password string, used *string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			if strings.Contains(strings.ToLower(question), "password") {
+				*used = usedPassword
+				answers[i] = password
+			}
+		}
+		return answers, nil
+	}
+}
+
+// copyPublicKey appends the public key for the first of keyPaths which
+// can be read to authorized_keys for the user logged in on conn, unless
+// it is already present
+func copyPublicKey(conn *ssh.Client, keyPaths []string, out io.Writer) error {
+	var publicKey ssh.PublicKey
+	var err error
+	for _, keyPath := range keyPaths {
+		if publicKey, err = readPublicKey(keyPath); err == nil {
+			break
+		}
+	}
+	if publicKey == nil {
+		return fmt.Errorf("no public key found for %s", strings.Join(keyPaths, ", "))
+	}
+
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+	command := fmt.Sprintf(`umask 077; mkdir -p ~/.ssh && (grep -qxF '%[1]s' ~/.ssh/authorized_keys 2>/dev/null || echo '%[1]s' >> ~/.ssh/authorized_keys)`, line)
+
+	sess, err := conn.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	if out, err := sess.CombinedOutput(command); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	fmt.Fprintf(out, "Added %s to authorized_keys for %s\n", ssh.FingerprintSHA256(publicKey), conn.User())
+	return nil
+}
+
+// readPublicKey reads the public key from the .pub file beside the
+// private key at path, or derives it from an unencrypted private key
+func readPublicKey(path string) (ssh.PublicKey, error) {
+	if pubkey, err := ioutil.ReadFile(path + ".pub"); err == nil {
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey(pubkey)
+		return publicKey, err
+	}
+
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file: %s, %s", path, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read public key %s.pub and unable to parse private key: %s", path, err)
+	}
+
+	return signer.PublicKey(), nil
+}
@@ -0,0 +1,290 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Methods of becoming root, see SSHOperator.SetBecome
+const (
+	BecomeSudo = "sudo"
+	BecomeDoas = "doas"
+	BecomeSu   = "su"
+	BecomeNone = "none"
+)
+
+// BecomeMethods lists every method of becoming root
+var BecomeMethods = []string{BecomeSudo, BecomeDoas, BecomeSu, BecomeNone}
+
+var (
+	// ErrPasswordRequired is returned when a password is needed to become
+	// root and none was given
+	ErrPasswordRequired = errors.New("a password is required to become root on this host")
+
+	// ErrPasswordIncorrect is returned when the password to become root
+	// was rejected
+	ErrPasswordIncorrect = errors.New("the password to become root was rejected")
+)
+
+// become runs whole commands as root, so that a password given on stdin
+// can never be read by a command in a pipeline
+type become struct {
+	method   string
+	password string
+
+	// pty is set once the host has refused to run the command without a
+	// terminal, such as with "Defaults requiretty" in sudoers. It is
+	// guarded by mu as commands may be run at the same time.
+	mu  sync.Mutex
+	pty bool
+}
+
+// newBecome returns nil for BecomeNone, as commands are run unchanged
+func newBecome(method string) (*become, error) {
+	switch method {
+	case BecomeSudo, BecomeDoas, BecomeSu:
+		return &become{method: method}, nil
+	case BecomeNone, "":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown method to become root %q, use one of: %s", method, strings.Join(BecomeMethods, ", "))
+}
+
+// command wraps command to run as root. Without a password sudo and doas
+// are told not to prompt, so that they fail straight away rather than
+// waiting for input which will never come.
+func (b *become) command(command string) string {
+	// stdin is closed for the command in case the password was not read
+	withPassword := ShellQuote("exec </dev/null\n" + command)
+
+	switch b.method {
+	case BecomeDoas:
+		if len(b.password) == 0 {
+			return "doas -n sh -c " + ShellQuote(command)
+		}
+		return "doas sh -c " + withPassword
+	case BecomeSu:
+		return "su root -c " + withPassword
+	}
+
+	if len(b.password) == 0 {
+		return "sudo -n sh -c " + ShellQuote(command)
+	}
+	// -p '' removes the prompt
+	return "sudo -S -p '' sh -c " + withPassword
+}
+
+// streamCommand wraps command to run as root with stdin passed through to
+// it, after the password for sudo. It is not used with a terminalPrompt.
+func (b *become) streamCommand(command string) string {
+	switch {
+	case b.method == BecomeDoas:
+		return "doas -n sh -c " + ShellQuote(command)
+	case len(b.password) == 0:
+		return "sudo -n sh -c " + ShellQuote(command)
+	}
+	return "sudo -S -p '' sh -c " + ShellQuote(command)
+}
+
+// localCommand wraps command to run as root on this machine. doas and su
+// are left to ask for the password on the terminal which runs k2sup.
+func (b *become) localCommand(command string) string {
+	switch b.method {
+	case BecomeDoas:
+		return "doas sh -c " + ShellQuote(command)
+	case BecomeSu:
+		return "su root -c " + ShellQuote(command)
+	}
+	return b.command(command)
+}
+
+// terminalPrompt reports whether the password can only be typed at a
+// terminal prompt, rather than written to stdin
+func (b *become) terminalPrompt() bool {
+	return len(b.password) > 0 && b.method != BecomeSudo
+}
+
+// stdin returns the input for a command wrapped by command, or nil when
+// the password is typed with passwordPrompt instead
+func (b *become) stdin() io.Reader {
+	if len(b.password) == 0 || b.terminalPrompt() {
+		return nil
+	}
+	return strings.NewReader(b.password + "\n")
+}
+
+// usePTY reports whether the host is known to need a terminal
+func (b *become) usePTY() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pty
+}
+
+// requirePTY records that the host needs a terminal, so that later
+// commands ask for one straight away
+func (b *become) requirePTY() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pty = true
+}
+
+// needsTTY reports whether the command was refused because there was no
+// terminal
+func (b *become) needsTTY(res CommandRes) bool {
+	output := string(res.StdErr) + string(res.StdOut)
+	for _, message := range []string{"must have a tty", "no tty present", "a tty is required", "must be run from a terminal"} {
+		if strings.Contains(output, message) {
+			return true
+		}
+	}
+	return false
+}
+
+// becomeFailure matches a line printed by sudo, doas or su when becoming
+// root failed due to the password
+type becomeFailure struct {
+	line *regexp.Regexp
+	err  error
+}
+
+// becomeFailures are matched against whole lines, and only for the method
+// in use, so that output from the command itself is not mistaken for them
+var becomeFailures = map[string][]becomeFailure{
+	BecomeSudo: {
+		{regexp.MustCompile(`^sudo: a password is required$`), ErrPasswordRequired},
+		{regexp.MustCompile(`^sudo: [0-9]+ incorrect password attempts?$`), ErrPasswordIncorrect},
+		{regexp.MustCompile(`^Sorry, try again\.$`), ErrPasswordIncorrect},
+	},
+	BecomeDoas: {
+		{regexp.MustCompile(`^doas: (Authorization required|a password is required)$`), ErrPasswordRequired},
+		{regexp.MustCompile(`^doas: Authentication failed$`), ErrPasswordIncorrect},
+	},
+	BecomeSu: {
+		{regexp.MustCompile(`^su: (Authentication failure|incorrect password)$`), ErrPasswordIncorrect},
+	},
+}
+
+// check replaces the error from a failed command with a clearer one when
+// becoming root failed due to the password. sudo, doas and su all exit
+// with status 1 when they refuse to run the command.
+func (b *become) check(res CommandRes, err error) error {
+	if err == nil || res.ExitCode != 1 {
+		return err
+	}
+
+	output := string(res.StdErr) + "\n" + string(res.StdOut)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		for _, failure := range becomeFailures[b.method] {
+			if failure.line.MatchString(line) {
+				return failure.err
+			}
+		}
+	}
+	return err
+}
+
+// passwordPrompt types the password once a prompt for it has been written
+// to the terminal, as su and doas discard any input sent before the
+// prompt. The prompt is removed from the output.
+type passwordPrompt struct {
+	password string
+	out      io.Writer
+
+	mu       sync.Mutex
+	line     []byte
+	watching bool
+	// skipNewline drops the newline printed after the password was read
+	skipNewline bool
+
+	prompted chan struct{}
+	done     chan struct{}
+	sent     bool
+}
+
+func newPasswordPrompt(password string, out io.Writer) *passwordPrompt {
+	return &passwordPrompt{
+		password: password,
+		out:      out,
+		watching: true,
+		prompted: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Write passes output through, apart from the prompt. Only the first line
+// is watched since the prompt comes before any output from the command.
+func (p *passwordPrompt) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.skipNewline {
+		trimmed := bytes.TrimLeft(b, "\r\n")
+		if len(trimmed) > 0 {
+			p.skipNewline = false
+		}
+		if _, err := p.out.Write(trimmed); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if !p.watching {
+		return p.out.Write(b)
+	}
+
+	p.line = append(p.line, b...)
+	text := strings.TrimSpace(string(p.line))
+	switch {
+	case strings.Contains(strings.ToLower(text), "password") && strings.HasSuffix(text, ":"):
+		p.watching = false
+		p.skipNewline = true
+		p.line = nil
+		close(p.prompted)
+	case bytes.ContainsAny(p.line, "\r\n"):
+		p.watching = false
+		if _, err := p.out.Write(p.line); err != nil {
+			return 0, err
+		}
+		p.line = nil
+	}
+
+	return len(b), nil
+}
+
+// Read returns the password once prompted, then blocks until close so
+// that the terminal is not hung up while the command runs
+func (p *passwordPrompt) Read(b []byte) (int, error) {
+	if !p.sent {
+		select {
+		case <-p.prompted:
+			p.sent = true
+			return copy(b, p.password+"\n"), nil
+		case <-p.done:
+			return 0, io.EOF
+		}
+	}
+
+	<-p.done
+	return 0, io.EOF
+}
+
+// close writes any output held back while looking for the prompt
+func (p *passwordPrompt) close() error {
+	close(p.done)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.line) > 0 {
+		_, err := p.out.Write(p.line)
+		p.line = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeBecome runs the wrapped command as the current user, after skipping
+// the options given to sudo, doas or su
+const fakeBecome = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-p) shift 2 ;;
+	-c) exec sh -c "$2" ;;
+	-*|root) shift ;;
+	*) break ;;
+	esac
+done
+exec "$@"
+`
+
+func Test_becomeCommand_Quoting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-become")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"sudo", "doas", "su"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(fakeBecome), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := `it's "$HOME" $(id)`
+	command := "printf %s " + ShellQuote(want)
+
+	for _, method := range []string{BecomeSudo, BecomeDoas, BecomeSu} {
+		for _, password := range []string{"", "secret"} {
+			b, err := newBecome(method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.password = password
+
+			cmd := exec.Command("sh", "-c", b.command(command))
+			cmd.Env = append(os.Environ(), "PATH="+dir+":"+os.Getenv("PATH"))
+			got, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("%s: %s", method, err)
+			}
+			if string(got) != want {
+				t.Errorf("%s with password %q: want %q, got %q", method, password, want, string(got))
+			}
+		}
+	}
+}
+
+func Test_newBecome_None(t *testing.T) {
+	for _, method := range []string{BecomeNone, ""} {
+		b, err := newBecome(method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != nil {
+			t.Errorf("%q: want commands to run unchanged", method)
+		}
+	}
+}
+
+func Test_newBecome_Unknown(t *testing.T) {
+	if _, err := newBecome("pkexec"); err == nil {
+		t.Errorf("want an error for an unknown method")
+	}
+}
+
+func Test_becomeCheck(t *testing.T) {
+	failed := errors.New("Process exited with status 1")
+
+	cases := []struct {
+		name   string
+		method string
+		res    CommandRes
+		want   error
+	}{
+		{"sudo without a password", BecomeSudo, CommandRes{StdErr: []byte("sudo: a password is required\n"), ExitCode: 1}, ErrPasswordRequired},
+		{"sudo with a wrong password", BecomeSudo, CommandRes{StdErr: []byte("Sorry, try again.\nsudo: no password was provided\nsudo: 1 incorrect password attempt\n"), ExitCode: 1}, ErrPasswordIncorrect},
+		{"doas without a password", BecomeDoas, CommandRes{StdErr: []byte("doas: Authorization required\n"), ExitCode: 1}, ErrPasswordRequired},
+		{"doas on a terminal", BecomeDoas, CommandRes{StdOut: []byte("doas: Authentication failed\r\n"), ExitCode: 1}, ErrPasswordIncorrect},
+		{"su with a wrong password", BecomeSu, CommandRes{StdOut: []byte("su: Authentication failure\r\n"), ExitCode: 1}, ErrPasswordIncorrect},
+		{"output of the command", BecomeSudo, CommandRes{StdErr: []byte("curl: Authentication failed\n"), ExitCode: 1}, failed},
+		{"output quoting sudo", BecomeSudo, CommandRes{StdErr: []byte("error: sudo: a password is required\n"), ExitCode: 1}, failed},
+		{"message of another method", BecomeSudo, CommandRes{StdErr: []byte("su: Authentication failure\n"), ExitCode: 1}, failed},
+		{"other exit code", BecomeSudo, CommandRes{StdErr: []byte("sudo: a password is required\n"), ExitCode: 2}, failed},
+	}
+
+	for _, c := range cases {
+		b, err := newBecome(c.method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := b.check(c.res, failed); got != c.want {
+			t.Errorf("%s: want %v, got %v", c.name, c.want, got)
+		}
+	}
+
+	b, _ := newBecome(BecomeSudo)
+	if err := b.check(CommandRes{StdErr: []byte("sudo: a password is required\n")}, nil); err != nil {
+		t.Errorf("want no error for a command which succeeded, got %v", err)
+	}
+}
+
+// dialOperator connects to the test server at address, with a client key
+// written to dir
+func dialOperator(t *testing.T, dir, address string) *SSHOperator {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := Target{Host: host, User: "k2sup"}
+	if target.Port, err = net.LookupPort("tcp", port); err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(dir, "id_ecdsa")
+	writeClientKey(t, keyPath)
+	connector, err := NewConnector(AuthOptions{
+		KeyPaths:      []string{keyPath},
+		HostKeyPolicy: HostKeyPolicyInsecure,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connector.Close() })
+
+	sshOperator, err := connector.Dial(context.Background(), target, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshOperator
+}
+
+// serveRequireTTY accepts sessions which fail as sudo does with
+// "Defaults requiretty" unless a terminal was asked for, refused counts
+// the sessions which failed
+func serveRequireTTY(t *testing.T, refused *int32) string {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(newHostSigner(t, ssh.KeyAlgoED25519))
+
+	return serveSSHChannels(t, config, func(newChannel ssh.NewChannel) {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions in tests")
+			return
+		}
+		channel, reqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		defer channel.Close()
+
+		pty := false
+		for req := range reqs {
+			switch req.Type {
+			case "pty-req":
+				pty = true
+				req.Reply(true, nil)
+			case "exec":
+				req.Reply(true, nil)
+				status := uint32(0)
+				if pty {
+					io.WriteString(channel, "ok\n")
+				} else {
+					atomic.AddInt32(refused, 1)
+					io.WriteString(channel.Stderr(), "sudo: sorry, you must have a tty to run sudo\n")
+					status = 1
+				}
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				return
+			default:
+				req.Reply(false, nil)
+			}
+		}
+	})
+}
+
+func Test_SSHOperator_BecomePTY(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-become")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	refused := int32(0)
+	sshOperator := dialOperator(t, dir, serveRequireTTY(t, &refused))
+	defer sshOperator.Close()
+	if err := sshOperator.SetBecome(BecomeSudo); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commands run at the same time, as they are when joining nodes
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := sshOperator.ExecuteStdio("true", false)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got := strings.TrimSpace(string(res.StdOut)); got != "ok" {
+				t.Errorf("want ok, got %q", got)
+			}
+		}()
+	}
+	wg.Wait()
+
+	before := atomic.LoadInt32(&refused)
+	if before == 0 {
+		t.Fatalf("want the first command to be refused without a terminal")
+	}
+	if _, err := sshOperator.ExecuteStdio("true", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&refused); got != before {
+		t.Errorf("want a terminal to be asked for once one was needed, got %d refused commands, want %d", got, before)
+	}
+}
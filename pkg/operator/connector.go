@@ -0,0 +1,362 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthOptions configures how a Connector authenticates to hosts and
+// verifies their host keys
+type AuthOptions struct {
+	// KeyPaths are the private keys tried in order when the SSH agent is
+	// unavailable or does not hold a key which the host accepts. When
+	// empty the default keys in ~/.ssh are tried, see DefaultKeyPaths.
+	KeyPaths []string
+
+	// CertPath is an OpenSSH user certificate for the first of KeyPaths,
+	// when empty <key>-cert.pub is used for each key if it exists
+	CertPath string
+
+	// HostKeyPolicy and KnownHostsPath configure host key verification,
+	// see HostKeyCallback
+	HostKeyPolicy  string
+	KnownHostsPath string
+
+	// HostCAPath is a file of CA public keys, host certificates signed
+	// by one of these are trusted without consulting known_hosts
+	HostCAPath string
+
+	// Password is tried with password and keyboard-interactive auth
+	// when no key is accepted
+	Password string
+
+	// CopyPublicKey appends the public key for the first of KeyPaths to
+	// the remote user's authorized_keys after logging in with Password
+	CopyPublicKey bool
+
+	// Timeout limits each attempt to open the TCP connection and to
+	// complete the SSH handshake, zero means no limit
+	Timeout time.Duration
+
+	// Retries is the number of times to retry when a host cannot be
+	// reached yet, such as while it boots, see Connector.dial
+	Retries int
+}
+
+// Target is a host to connect to over SSH
+type Target struct {
+	Host string
+	Port int
+	User string
+
+	// KeyPaths overrides AuthOptions.KeyPaths for this host
+	KeyPaths []string
+
+	// Bastions are connected to in order, each one through the previous,
+	// and the host is then reached through the last bastion
+	Bastions []Target
+}
+
+// Address returns the host:port to dial
+func (t Target) Address() string {
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+}
+
+// Connector opens SSH connections using one set of AuthOptions, so that
+// every command authenticates the same way. Connections to bastions are
+// shared by all targets reached through them and are closed by Close.
+type Connector struct {
+	auth     AuthOptions
+	hostKeys *HostKeys
+	// keys holds the keys decrypted with a passphrase, so that it is
+	// only asked for once
+	keys *decryptedKeys
+
+	mu       sync.Mutex
+	bastions map[string]*ssh.Client
+	// opened records bastion connections in the order they were made,
+	// so they can be closed starting with the furthest hop
+	opened []*ssh.Client
+}
+
+// NewConnector creates a Connector, loading the known_hosts file
+// according to the host key policy
+func NewConnector(auth AuthOptions) (*Connector, error) {
+	hostKeys, err := NewHostKeys(auth.HostKeyPolicy, auth.KnownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(auth.HostCAPath) > 0 {
+		if err := hostKeys.TrustHostCAs(auth.HostCAPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Connector{
+		auth:     auth,
+		hostKeys: hostKeys,
+		keys:     newDecryptedKeys(),
+		bastions: map[string]*ssh.Client{},
+	}, nil
+}
+
+// Dial connects to target, tunnelling through its bastions. Progress,
+// such as the identity which authenticated, is written to out, or to
+// os.Stdout when out is nil.
+func (c *Connector) Dial(ctx context.Context, target Target, out io.Writer) (*SSHOperator, error) {
+	if out == nil {
+		out = os.Stdout
+	}
+
+	via, err := c.bastion(ctx, target.Bastions, out)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.connect(ctx, via, target, out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SSHOperator{conn: conn}, nil
+}
+
+// Close closes the connections to every bastion
+func (c *Connector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	for i := len(c.opened) - 1; i >= 0; i-- {
+		if closeErr := c.opened[i].Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	c.opened = nil
+	c.bastions = map[string]*ssh.Client{}
+
+	return err
+}
+
+// Dial connects to a single target, the connections to any bastions are
+// closed along with the returned operator
+func Dial(ctx context.Context, target Target, auth AuthOptions) (*SSHOperator, error) {
+	connector, err := NewConnector(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	sshOperator, err := connector.Dial(ctx, target, os.Stdout)
+	if err != nil {
+		connector.Close()
+		return nil, err
+	}
+	sshOperator.bastions = connector
+
+	return sshOperator, nil
+}
+
+// bastion returns the client for the last of hops, connecting to any
+// hop which is not already connected
+func (c *Connector) bastion(ctx context.Context, hops []Target, out io.Writer) (*ssh.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var via *ssh.Client
+	chain := []string{}
+	for _, hop := range hops {
+		chain = append(chain, hop.User+"@"+hop.Address())
+		key := strings.Join(chain, ",")
+
+		if client, ok := c.bastions[key]; ok {
+			via = client
+			continue
+		}
+
+		fmt.Fprintf(out, "Connecting to bastion: %s@%s\n", hop.User, hop.Address())
+
+		client, err := c.connect(ctx, via, hop, out)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to bastion: %s", err)
+		}
+
+		c.bastions[key] = client
+		c.opened = append(c.opened, client)
+		via = client
+	}
+
+	return via, nil
+}
+
+// connect authenticates with every identity held by the SSH agent, then
+// falls back to each private key file in turn and finally to a password
+func (c *Connector) connect(ctx context.Context, via *ssh.Client, target Target, out io.Writer) (*ssh.Client, error) {
+	address := target.Address()
+
+	// used records the identity which authenticated
+	used := ""
+
+	if runtime.GOOS != "windows" {
+		if signers, closeSSHAgent, err := agentSigners(&used); err == nil {
+			// Try SSH agent without parsing key files, will succeed if the user
+			// has already added a key to the SSH Agent, or if using a configured
+			// smartcard
+			client, err := c.dial(ctx, via, address, c.clientConfig(target, out, ssh.PublicKeys(signers...)), out)
+			closeSSHAgent()
+			if err == nil {
+				fmt.Fprintf(out, "Authenticated to %s as %s using %s\n", address, target.User, used)
+				return client, nil
+			}
+			// Only a rejected key is worth trying again with the key files
+			if ctx.Err() != nil || isTransient(err) {
+				return nil, fmt.Errorf("unable to connect to %s over ssh: %s", address, err)
+			}
+		}
+	}
+
+	keyPaths, certPath := target.KeyPaths, ""
+	if len(keyPaths) == 0 {
+		keyPaths, certPath = c.auth.KeyPaths, c.auth.CertPath
+	}
+	if len(keyPaths) == 0 {
+		keyPaths = DefaultKeyPaths()
+	}
+
+	signers := []ssh.Signer{}
+	loadErrs := []string{}
+	for i, keyPath := range keyPaths {
+		keyCertPath := ""
+		if i == 0 {
+			keyCertPath = certPath
+		}
+
+		keySigners, closeSSHAgent, err := loadPublickey(keyPath, keyCertPath, c.keys)
+		if err != nil {
+			loadErrs = append(loadErrs, fmt.Sprintf("unable to load the ssh key with path %q: %s", keyPath, err))
+			continue
+		}
+		defer closeSSHAgent()
+
+		for _, signer := range keySigners {
+			name := keyPath
+			if _, ok := signer.PublicKey().(*ssh.Certificate); ok {
+				name = keyPath + " (certificate)"
+			}
+			signers = append(signers, recordIdentity(signer, name, &used))
+		}
+	}
+
+	passwordAuth := c.passwordAuth(&used)
+
+	// A host which only has a password set up can still be reached
+	if len(signers) == 0 && len(passwordAuth) == 0 {
+		if len(loadErrs) == 0 {
+			return nil, fmt.Errorf("no ssh key found, give one with --ssh-key or add one to the ssh agent")
+		}
+		return nil, fmt.Errorf("%s", strings.Join(loadErrs, "\n"))
+	}
+
+	for _, loadErr := range loadErrs {
+		fmt.Fprintln(out, loadErr)
+	}
+
+	auth := []ssh.AuthMethod{}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	auth = append(auth, passwordAuth...)
+
+	client, err := c.dial(ctx, via, address, c.clientConfig(target, out, auth...), out)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s over ssh as %s: %s", address, target.User, err)
+	}
+
+	fmt.Fprintf(out, "Authenticated to %s as %s using %s\n", address, target.User, used)
+
+	if used == usedPassword && c.auth.CopyPublicKey {
+		if err := copyPublicKey(client, keyPaths, out); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("unable to add public key to authorized_keys on %s: %s", address, err)
+		}
+	}
+
+	return client, nil
+}
+
+func (c *Connector) clientConfig(target Target, out io.Writer, auth ...ssh.AuthMethod) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:              target.User,
+		Auth:              auth,
+		HostKeyCallback:   c.hostKeys.CallbackTo(out),
+		HostKeyAlgorithms: c.hostKeys.Algorithms(target.Address()),
+		Timeout:           c.auth.Timeout,
+	}
+}
+
+// dialContext opens an SSH client connection to address, tunnelling the
+// TCP connection through via when it is not nil. The handshake is
+// aborted if ctx is cancelled or it takes longer than config.Timeout.
+func dialContext(ctx context.Context, via *ssh.Client, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+	if via == nil {
+		dialer := net.Dialer{Timeout: config.Timeout}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = via.Dial("tcp", address)
+		if err != nil {
+			err = fmt.Errorf("unable to reach %s through bastion %s: %s", address, via.RemoteAddr(), err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Timeout only bounds the TCP dial, a host which accepts the
+	// connection and then stalls would otherwise hang the handshake
+	handshakeCtx := ctx
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		handshakeCtx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-handshakeCtx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	close(done)
+	if err == nil && handshakeCtx.Err() != nil {
+		sshConn.Close()
+		err = handshakeCtx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if handshakeCtx.Err() != nil {
+			return nil, &handshakeTimeoutError{address: address, timeout: config.Timeout}
+		}
+		return nil, err
+	}
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
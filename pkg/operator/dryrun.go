@@ -0,0 +1,153 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// DryRunRecord is a command or an upload recorded by DryRunOperator,
+// Target is only set for uploads
+type DryRunRecord struct {
+	Command string
+
+	Target   string
+	Mode     os.FileMode
+	Owner    string
+	Contents []byte
+}
+
+// DryRunOperator records the commands and uploads which would be run on
+// Host, and prints them to Out rather than connecting. Every command
+// succeeds with no output.
+type DryRunOperator struct {
+	Host string
+	Out  io.Writer
+
+	// Secrets are redacted from everything printed, see Redact
+	Secrets []string
+
+	// Records lists everything in the order it would have been run
+	Records []DryRunRecord
+
+	// become is the method used to run commands as root, it is only
+	// printed
+	become string
+
+	// mu guards Records and Out, as parallel joins share the operator
+	// for the server
+	mu sync.Mutex
+}
+
+// NewDryRunOperator returns a DryRunOperator which prints to stdout
+func NewDryRunOperator(host string) *DryRunOperator {
+	return &DryRunOperator{
+		Host: host,
+		Out:  os.Stdout,
+	}
+}
+
+// SetBecome sets how every command would be run as root, one of
+// BecomeMethods
+func (d *DryRunOperator) SetBecome(method string) error {
+	b, err := newBecome(method)
+	if err != nil {
+		return err
+	}
+	d.become = ""
+	if b != nil {
+		d.become = b.method
+	}
+	return nil
+}
+
+// SetOutput prints to stdout, nothing is written to stderr
+func (d *DryRunOperator) SetOutput(stdout, stderr io.Writer) {
+	d.Out = stdout
+}
+
+// SetBecomePassword does nothing, as no command is run
+func (d *DryRunOperator) SetBecomePassword(password string) {
+}
+
+func (d *DryRunOperator) Execute(command string) (CommandRes, error) {
+	return d.ExecuteStdioContext(context.Background(), command, true)
+}
+
+func (d *DryRunOperator) ExecuteStdio(command string, stream bool) (CommandRes, error) {
+	return d.ExecuteStdioContext(context.Background(), command, stream)
+}
+
+func (d *DryRunOperator) ExecuteContext(ctx context.Context, command string) (CommandRes, error) {
+	return d.ExecuteStdioContext(ctx, command, true)
+}
+
+// ExecuteStdioContext records command, it fails only when ctx is done
+func (d *DryRunOperator) ExecuteStdioContext(ctx context.Context, command string, stream bool) (CommandRes, error) {
+	if err := ctx.Err(); err != nil {
+		return CommandRes{ExitCode: -1}, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Records = append(d.Records, DryRunRecord{Command: command})
+
+	prompt := "$"
+	if len(d.become) > 0 {
+		prompt = fmt.Sprintf("(%s) #", d.become)
+	}
+	fmt.Fprintf(d.Out, "[dry-run] %s %s %s\n", d.Host, prompt, d.redact(strings.TrimSpace(command)))
+
+	return CommandRes{}, nil
+}
+
+// Upload records the contents of source and prints them, unless they are
+// binary such as a tarball
+func (d *DryRunOperator) Upload(source io.Reader, target string, mode os.FileMode, owner string) error {
+	contents, err := ioutil.ReadAll(source)
+	if err != nil {
+		return fmt.Errorf("unable to read the file for %s: %s", target, err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Records = append(d.Records, DryRunRecord{
+		Target:   target,
+		Mode:     mode,
+		Owner:    owner,
+		Contents: contents,
+	})
+
+	ownedBy := ""
+	if len(owner) > 0 {
+		ownedBy = ", owner " + owner
+	}
+	if !utf8.Valid(contents) || bytes.IndexByte(contents, 0) >= 0 {
+		fmt.Fprintf(d.Out, "[dry-run] %s write %s (mode %04o%s): %d bytes of binary data\n", d.Host, target, mode.Perm(), ownedBy, len(contents))
+		return nil
+	}
+
+	fmt.Fprintf(d.Out, "[dry-run] %s write %s (mode %04o%s):\n", d.Host, target, mode.Perm(), ownedBy)
+	for _, line := range strings.Split(strings.TrimRight(d.redact(string(contents)), "\n"), "\n") {
+		fmt.Fprintf(d.Out, "    %s\n", line)
+	}
+
+	return nil
+}
+
+// Close does nothing, it allows DryRunOperator to be used as an Operator
+func (d *DryRunOperator) Close() error {
+	return nil
+}
+
+func (d *DryRunOperator) redact(text string) string {
+	return Redact(text, d.Secrets)
+}
@@ -0,0 +1,41 @@
+package ssh
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_DryRunOperator_RecordsAndRedacts(t *testing.T) {
+	out := bytes.Buffer{}
+	op := &DryRunOperator{Host: "node1", Out: &out, Secrets: []string{"K10secret"}}
+	if err := op.SetBecome(BecomeDoas); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := op.Execute("echo K10secret > /tmp/token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := op.Upload(strings.NewReader("server: https://10.0.0.1:9345\ntoken: abc\n"), "/etc/rancher/rke2/config.yaml", 0600, "root"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(op.Records) != 2 {
+		t.Fatalf("want 2 records, got %d", len(op.Records))
+	}
+	if op.Records[0].Command != "echo K10secret > /tmp/token" {
+		t.Errorf("want the command recorded unchanged, got %q", op.Records[0].Command)
+	}
+	if op.Records[1].Target != "/etc/rancher/rke2/config.yaml" || op.Records[1].Mode != 0600 {
+		t.Errorf("want the upload recorded, got %+v", op.Records[1])
+	}
+
+	want := `[dry-run] node1 (doas) # echo <redacted> > /tmp/token
+[dry-run] node1 write /etc/rancher/rke2/config.yaml (mode 0600, owner root):
+    server: https://10.0.0.1:9345
+    token: <redacted>
+`
+	if out.String() != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, out.String())
+	}
+}
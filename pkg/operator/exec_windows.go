@@ -0,0 +1,14 @@
+package ssh
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing on Windows, where only the process run
+// by killProcessGroup is killed
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
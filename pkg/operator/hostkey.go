@@ -0,0 +1,366 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// HostKeyPolicyStrict only accepts hosts which are already present
+	// in the known_hosts file
+	HostKeyPolicyStrict = "strict"
+
+	// HostKeyPolicyTOFU trusts a host the first time it is seen and
+	// appends its key to the known_hosts file, after which the key
+	// must match on every connection
+	HostKeyPolicyTOFU = "tofu"
+
+	// HostKeyPolicyInsecure disables host key verification
+	HostKeyPolicyInsecure = "insecure"
+)
+
+// HostKeyMismatchError is returned when a host presents a key which
+// differs from the one recorded in the known_hosts file
+type HostKeyMismatchError struct {
+	Host           string
+	Fingerprint    string
+	KnownHostsFile string
+	Line           int
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf(`host key verification failed for %s
+the host presented key %s, which does not match the key recorded in %s:%d
+it is possible that someone is impersonating this host, remove the entry if the key was changed on purpose`,
+		e.Host, e.Fingerprint, e.KnownHostsFile, e.Line)
+}
+
+// HostKeyCallback returns a callback verifying host keys against the
+// known_hosts file at knownHostsPath according to the given policy
+func HostKeyCallback(policy, knownHostsPath string) (ssh.HostKeyCallback, error) {
+	hostKeys, err := NewHostKeys(policy, knownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+	return hostKeys.Callback, nil
+}
+
+// HostKeys verifies the keys presented by hosts against a known_hosts
+// file, and chooses the host key algorithms offered to each host so that
+// it presents a key which is already recorded
+type HostKeys struct {
+	policy         string
+	knownHostsPath string
+
+	// known checks keys against the known_hosts file, it is nil when
+	// host keys are not verified
+	known ssh.HostKeyCallback
+	// knownAuthorities is true when the known_hosts file holds
+	// @cert-authority lines
+	knownAuthorities bool
+
+	// authorities are the host CA keys given with TrustHostCAs
+	authorities map[string]bool
+
+	// mu serialises hosts which are connected to at the same time, so
+	// that each key is only added once
+	mu sync.Mutex
+	// trusted holds the keys trusted during this run by hostname, the
+	// known_hosts file is only parsed once
+	trusted map[string][]ssh.PublicKey
+}
+
+// NewHostKeys loads the known_hosts file at knownHostsPath, which is
+// created when the policy trusts new hosts
+func NewHostKeys(policy, knownHostsPath string) (*HostKeys, error) {
+	switch policy {
+	case HostKeyPolicyInsecure:
+		return &HostKeys{policy: policy}, nil
+	case HostKeyPolicyStrict, HostKeyPolicyTOFU:
+	default:
+		return nil, fmt.Errorf("unknown host key policy %q, use one of: %s, %s, %s",
+			policy, HostKeyPolicyStrict, HostKeyPolicyTOFU, HostKeyPolicyInsecure)
+	}
+
+	if _, err := os.Stat(knownHostsPath); err != nil {
+		if !os.IsNotExist(err) || policy == HostKeyPolicyStrict {
+			return nil, fmt.Errorf("unable to read known_hosts file %s: %s", knownHostsPath, err)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(knownHostsPath), 0700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(knownHostsPath, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+
+	known, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse known_hosts file %s: %s", knownHostsPath, err)
+	}
+	data, err := ioutil.ReadFile(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read known_hosts file %s: %s", knownHostsPath, err)
+	}
+
+	knownAuthorities := false
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "@cert-authority") {
+			knownAuthorities = true
+		}
+	}
+
+	return &HostKeys{
+		policy:           policy,
+		knownHostsPath:   knownHostsPath,
+		known:            known,
+		knownAuthorities: knownAuthorities,
+		trusted:          map[string][]ssh.PublicKey{},
+	}, nil
+}
+
+// Callback verifies the key presented by hostname, it is used as
+// ssh.ClientConfig.HostKeyCallback
+func (h *HostKeys) Callback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	return h.verify(hostname, remote, key, os.Stdout)
+}
+
+// CallbackTo is Callback, but reports the keys which are added to the
+// known_hosts file to out
+func (h *HostKeys) CallbackTo(out io.Writer) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return h.verify(hostname, remote, key, out)
+	}
+}
+
+func (h *HostKeys) verify(hostname string, remote net.Addr, key ssh.PublicKey, out io.Writer) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if signed, err := h.checkCert(hostname, remote, cert); signed || err != nil {
+			return err
+		}
+		// Without a CA for the certificate the key it certifies is
+		// verified as a plain key, as OpenSSH does
+		key = cert.Key
+	}
+
+	if h.known == nil {
+		return nil
+	}
+
+	err := h.known(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, trusted := range h.trusted[knownhosts.Normalize(hostname)] {
+		if bytes.Equal(trusted.Marshal(), key.Marshal()) {
+			return nil
+		}
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	// Only a different key of the same type means the host changed, a
+	// host which presents a type that was never recorded is treated as
+	// a new host, as OpenSSH does
+	for _, want := range keyErr.Want {
+		if want.Key.Type() == key.Type() {
+			return &HostKeyMismatchError{
+				Host:           hostname,
+				Fingerprint:    fingerprint,
+				KnownHostsFile: want.Filename,
+				Line:           want.Line,
+			}
+		}
+	}
+
+	if h.policy == HostKeyPolicyStrict {
+		return fmt.Errorf("host %s (%s %s) is not present in %s, add it with ssh-keyscan or use --host-key-policy=%s",
+			hostname, key.Type(), fingerprint, h.knownHostsPath, HostKeyPolicyTOFU)
+	}
+
+	if err := appendKnownHost(h.knownHostsPath, hostname, remote, key, out); err != nil {
+		return err
+	}
+	h.trusted[knownhosts.Normalize(hostname)] = append(h.trusted[knownhosts.Normalize(hostname)], key)
+	return nil
+}
+
+// checkCert verifies a host certificate signed by a CA given to
+// TrustHostCAs or named by an @cert-authority line in known_hosts,
+// signed is false when none of them signed it
+func (h *HostKeys) checkCert(hostname string, remote net.Addr, cert *ssh.Certificate) (bool, error) {
+	if h.authorities[string(cert.SignatureKey.Marshal())] {
+		checker := &ssh.CertChecker{
+			IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+				return true
+			},
+		}
+		return true, checker.CheckHostKey(hostname, remote, cert)
+	}
+
+	if h.known == nil || !h.knownAuthorities {
+		return false, nil
+	}
+	err := h.known(hostname, remote, cert)
+	if err != nil && strings.HasPrefix(err.Error(), "ssh: no authorities for hostname") {
+		return false, nil
+	}
+	return true, err
+}
+
+// TrustHostCAs trusts host certificates signed by one of the CA public
+// keys in caPath, hosts presenting a plain key are still verified against
+// the known_hosts file
+func (h *HostKeys) TrustHostCAs(caPath string) error {
+	data, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return fmt.Errorf("unable to read host CA file %s: %s", caPath, err)
+	}
+
+	authorities := map[string]bool{}
+	for len(bytes.TrimSpace(data)) > 0 {
+		var ca ssh.PublicKey
+		ca, _, _, data, err = ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// Only comments remain after the last key
+			if len(authorities) > 0 && err.Error() == "ssh: no key found" {
+				break
+			}
+			return fmt.Errorf("unable to parse host CA file %s: %s", caPath, err)
+		}
+		authorities[string(ca.Marshal())] = true
+	}
+
+	if len(authorities) == 0 {
+		return fmt.Errorf("no CA keys found in host CA file %s", caPath)
+	}
+
+	h.authorities = authorities
+	return nil
+}
+
+// hostCertAlgorithms and hostKeyAlgorithms are the host key algorithms
+// supported by x/crypto/ssh, in the order OpenSSH prefers them
+var (
+	hostCertAlgorithms = []string{
+		ssh.CertAlgoED25519v01,
+		ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+		ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01,
+	}
+	hostKeyAlgorithms = []string{
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+	}
+)
+
+// Algorithms returns the host key algorithms to offer to the host at
+// address. Certificates are only asked for when a host CA is trusted.
+// As with OpenSSH, the types of the keys already recorded for the host
+// come next, so that a trusted host is not asked for a key which was
+// never recorded, followed by the remaining algorithms.
+func (h *HostKeys) Algorithms(address string) []string {
+	preferred := []string{}
+	if len(h.authorities) > 0 || h.knownAuthorities {
+		preferred = append(preferred, hostCertAlgorithms...)
+	}
+	if h.known == nil {
+		return append(preferred, hostKeyAlgorithms...)
+	}
+
+	known := map[string]bool{}
+	for _, key := range h.knownKeys(address) {
+		known[key.Type()] = true
+	}
+
+	rest := []string{}
+	for _, algorithm := range hostKeyAlgorithms {
+		if known[algorithm] {
+			preferred = append(preferred, algorithm)
+		} else {
+			rest = append(rest, algorithm)
+		}
+	}
+	return append(preferred, rest...)
+}
+
+// knownKeys returns the keys recorded for the host at address, in the
+// known_hosts file or during this run
+func (h *HostKeys) knownKeys(address string) []ssh.PublicKey {
+	keys := []ssh.PublicKey{}
+
+	// The known_hosts database cannot be listed, but checking a key
+	// which never matches returns every key recorded for the host
+	var keyErr *knownhosts.KeyError
+	if err := h.known(address, &net.TCPAddr{}, probeKey{}); errors.As(err, &keyErr) {
+		for _, want := range keyErr.Want {
+			keys = append(keys, want.Key)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append(keys, h.trusted[knownhosts.Normalize(address)]...)
+}
+
+// probeKey is a public key which is never recorded for any host
+type probeKey struct{}
+
+func (probeKey) Type() string {
+	return "k2sup-probe"
+}
+
+func (probeKey) Marshal() []byte {
+	return []byte("k2sup-probe")
+}
+
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error {
+	return errors.New("a probe key cannot verify signatures")
+}
+
+func appendKnownHost(knownHostsPath, hostname string, remote net.Addr, key ssh.PublicKey, out io.Writer) error {
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil {
+		if remoteAddr := knownhosts.Normalize(remote.String()); remoteAddr != addresses[0] {
+			addresses = append(addresses, remoteAddr)
+		}
+	}
+
+	f, err := os.OpenFile(knownHostsPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, knownhosts.Line(addresses, key)); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Permanently added %s (%s %s) to the list of known hosts.\n",
+		hostname, key.Type(), ssh.FingerprintSHA256(key))
+
+	return nil
+}
@@ -0,0 +1,393 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func Test_HostKeyCallback_TOFU(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	remote := &net.TCPAddr{IP: net.ParseIP("192.168.0.10"), Port: 22}
+	key := newHostKey(t)
+
+	callback, err := HostKeyCallback(HostKeyPolicyTOFU, knownHostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callback("192.168.0.10:22", remote, key); err != nil {
+		t.Fatalf("want first key to be trusted, got: %s", err)
+	}
+
+	// A fresh callback must read the key back from the file
+	callback, err = HostKeyCallback(HostKeyPolicyStrict, knownHostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callback("192.168.0.10:22", remote, key); err != nil {
+		t.Fatalf("want recorded key to be accepted, got: %s", err)
+	}
+
+	err = callback("192.168.0.10:22", remote, newHostKey(t))
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("want: HostKeyMismatchError, but got: %v", err)
+	}
+}
+
+func Test_HostKeyCallback_StrictUnknownHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	if _, err := HostKeyCallback(HostKeyPolicyStrict, knownHostsPath); err == nil {
+		t.Fatalf("want error for missing known_hosts file in strict mode")
+	}
+
+	if err := ioutil.WriteFile(knownHostsPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	callback, err := HostKeyCallback(HostKeyPolicyStrict, knownHostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &net.TCPAddr{IP: net.ParseIP("192.168.0.10"), Port: 22}
+	if err := callback("192.168.0.10:22", remote, newHostKey(t)); err == nil {
+		t.Fatalf("want unknown host to be rejected in strict mode")
+	}
+}
+
+func newHostSigner(t *testing.T, keyType string) ssh.Signer {
+	var key interface{}
+	var err error
+	switch keyType {
+	case ssh.KeyAlgoED25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case ssh.KeyAlgoECDSA256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		t.Fatalf("unsupported key type %s", keyType)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// writeClientKey writes an unencrypted ECDSA private key to path and
+// returns its public key
+func writeClientKey(t *testing.T, path string) ssh.PublicKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+// startSSHServer accepts SSH connections from any client on a local
+// port, presenting hostKeys, and returns its address
+func startSSHServer(t *testing.T, hostKeys ...ssh.Signer) string {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	for _, hostKey := range hostKeys {
+		config.AddHostKey(hostKey)
+	}
+	return serveSSH(t, config)
+}
+
+// serveSSH accepts SSH connections configured by config on a local port
+// and returns its address, every channel is rejected
+func serveSSH(t *testing.T, config *ssh.ServerConfig) string {
+	return serveSSHChannels(t, config, func(newChannel ssh.NewChannel) {
+		newChannel.Reject(ssh.Prohibited, "no channels in tests")
+	})
+}
+
+// serveSSHChannels is serveSSH, passing each channel opened to handle
+func serveSSHChannels(t *testing.T, config *ssh.ServerConfig, handle func(ssh.NewChannel)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				defer sshConn.Close()
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					go handle(newChannel)
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// dialTestServer connects to address with a Connector verifying host keys
+// as auth sets out
+func dialTestServer(t *testing.T, address string, auth AuthOptions) error {
+	return dialTestServerOutput(t, address, auth, ioutil.Discard)
+}
+
+// dialTestServerOutput is dialTestServer, writing progress to out
+func dialTestServerOutput(t *testing.T, address string, auth AuthOptions, out io.Writer) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := Target{Host: host, User: "k2sup"}
+	if target.Port, err = net.LookupPort("tcp", port); err != nil {
+		t.Fatal(err)
+	}
+
+	auth.KeyPaths = []string{filepath.Join(filepath.Dir(auth.KnownHostsPath), "id_ecdsa")}
+	writeClientKey(t, auth.KeyPaths[0])
+
+	connector, err := NewConnector(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connector.Close()
+
+	sshOperator, err := connector.Dial(context.Background(), target, out)
+	if err != nil {
+		return err
+	}
+	return sshOperator.Close()
+}
+
+func Test_Connector_Dial_Output(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	address := startSSHServer(t, newHostSigner(t, ssh.KeyAlgoED25519))
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+
+	// Nodes joined in parallel prefix their output with the host, so
+	// nothing may go straight to os.Stdout
+	out := &bytes.Buffer{}
+	if err := dialTestServerOutput(t, address, AuthOptions{HostKeyPolicy: HostKeyPolicyTOFU, KnownHostsPath: knownHostsPath}, out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Permanently added " + address, "Authenticated to " + address} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("want %q in %q", want, out.String())
+		}
+	}
+}
+
+func Test_Connector_KnownKeyTypeOffered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ed25519Key := newHostSigner(t, ssh.KeyAlgoED25519)
+	address := startSSHServer(t, newHostSigner(t, ssh.KeyAlgoECDSA256), ed25519Key)
+
+	// Only the ed25519 key is recorded, as ssh-keyscan -t ed25519 would
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, ed25519Key.PublicKey())
+	if err := ioutil.WriteFile(knownHostsPath, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dialTestServer(t, address, AuthOptions{HostKeyPolicy: HostKeyPolicyStrict, KnownHostsPath: knownHostsPath}); err != nil {
+		t.Fatalf("want the recorded ed25519 key to be negotiated, got: %s", err)
+	}
+
+	// A different ed25519 key is still a mismatch
+	line = knownhosts.Line([]string{knownhosts.Normalize(address)}, newHostKey(t))
+	if err := ioutil.WriteFile(knownHostsPath, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = dialTestServer(t, address, AuthOptions{HostKeyPolicy: HostKeyPolicyTOFU, KnownHostsPath: knownHostsPath})
+	if err == nil || !strings.Contains(err.Error(), "does not match the key recorded") {
+		t.Fatalf("want a host key mismatch, but got: %v", err)
+	}
+}
+
+func Test_HostKeyCallback_NewKeyType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{"192.168.0.10"}, newHostKey(t))
+	if err := ioutil.WriteFile(knownHostsPath, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	callback, err := HostKeyCallback(HostKeyPolicyStrict, knownHostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &net.TCPAddr{IP: net.ParseIP("192.168.0.10"), Port: 22}
+	err = callback("192.168.0.10:22", remote, newHostSigner(t, ssh.KeyAlgoECDSA256).PublicKey())
+	var mismatch *HostKeyMismatchError
+	if err == nil || errors.As(err, &mismatch) {
+		t.Fatalf("want a key of a new type to be treated as unknown in strict mode, got: %v", err)
+	}
+}
+
+func Test_HostKeys_Algorithms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{"192.168.0.10"}, newHostSigner(t, ssh.KeyAlgoECDSA256).PublicKey())
+	if err := ioutil.WriteFile(knownHostsPath, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	hostKeys, err := NewHostKeys(HostKeyPolicyStrict, knownHostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hostKeys.Algorithms("192.168.0.10:22"); got[0] != ssh.KeyAlgoECDSA256 {
+		t.Errorf("want the recorded key type first, got %v", got)
+	}
+	if got := hostKeys.Algorithms("192.168.0.11:22"); !reflect.DeepEqual(got, hostKeyAlgorithms) {
+		t.Errorf("want only plain keys in the default order for an unknown host, got %v", got)
+	}
+}
+
+// newHostCertSigner returns the host key signer and a signer presenting
+// a certificate for it, signed by ca for 127.0.0.1
+func newHostCertSigner(t *testing.T, ca ssh.Signer) (ssh.Signer, ssh.Signer) {
+	hostKey := newHostSigner(t, ssh.KeyAlgoED25519)
+	cert := &ssh.Certificate{
+		Key:             hostKey.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hostKey, certSigner
+}
+
+func Test_Connector_HostCertWithoutCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostKey, certSigner := newHostCertSigner(t, newHostSigner(t, ssh.KeyAlgoED25519))
+	address := startSSHServer(t, certSigner, hostKey)
+
+	// The plain key is trusted on first use, and then matched
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	for _, policy := range []string{HostKeyPolicyTOFU, HostKeyPolicyStrict} {
+		if err := dialTestServer(t, address, AuthOptions{HostKeyPolicy: policy, KnownHostsPath: knownHostsPath}); err != nil {
+			t.Fatalf("%s: want the plain host key to be verified, got: %s", policy, err)
+		}
+	}
+}
+
+func Test_Connector_HostCertWithCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newHostSigner(t, ssh.KeyAlgoED25519)
+	hostKey, certSigner := newHostCertSigner(t, ca)
+	address := startSSHServer(t, certSigner, hostKey)
+
+	hostCAPath := filepath.Join(dir, "host_ca.pub")
+	if err := ioutil.WriteFile(hostCAPath, ssh.MarshalAuthorizedKey(ca.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(knownHostsPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Strict mode only passes when the certificate is checked
+	auth := AuthOptions{HostKeyPolicy: HostKeyPolicyStrict, KnownHostsPath: knownHostsPath, HostCAPath: hostCAPath}
+	if err := dialTestServer(t, address, auth); err != nil {
+		t.Fatalf("want the host certificate to be trusted, got: %s", err)
+	}
+}
@@ -1,35 +1,210 @@
 package ssh
 
 import (
-	goexecute "github.com/alexellis/go-execute/pkg/v1"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
 )
 
 type CommandOperator interface {
 	Execute(command string) (CommandRes, error)
 	ExecuteStdio(command string, stream bool) (CommandRes, error)
+	ExecuteContext(ctx context.Context, command string) (CommandRes, error)
+	ExecuteStdioContext(ctx context.Context, command string, stream bool) (CommandRes, error)
 }
 
+// Operator runs commands and writes files on a host, either over SSH
+// with SSHOperator or on this machine with ExecOperator
+type Operator interface {
+	CommandOperator
+	Uploader
+	Close() error
+}
+
+// streams is where the output of commands is written as they run
+type streams struct {
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// SetOutput streams the output of commands to stdout and stderr rather
+// than os.Stdout and os.Stderr, such as to prefix each line with the host
+func (s *streams) SetOutput(stdout, stderr io.Writer) {
+	s.stdout = stdout
+	s.stderr = stderr
+}
+
+func (s streams) outputs() (io.Writer, io.Writer) {
+	stdout, stderr := s.stdout, s.stderr
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	return stdout, stderr
+}
+
+// ExecOperator runs commands on this machine
 type ExecOperator struct {
+	streams
+
+	// become runs every command as root when it is not nil
+	become *become
 }
 
-func (ex ExecOperator) ExecuteStdio(command string, stream bool) (CommandRes, error) {
-	task := goexecute.ExecTask{
-		Command:     command,
-		Shell:       true,
-		StreamStdio: stream,
+// SetBecome sets how every command is run as root, one of BecomeMethods
+func (ex *ExecOperator) SetBecome(method string) error {
+	become, err := newBecome(method)
+	if err != nil {
+		return err
+	}
+	ex.become = become
+	return nil
+}
+
+// SetBecomePassword sets the password given to sudo, doas and su ask for
+// theirs on the terminal when running on this machine
+func (ex *ExecOperator) SetBecomePassword(password string) {
+	if ex.become != nil {
+		ex.become.password = password
+	}
+}
+
+// Upload copies source to target on this machine, in the same way as
+// SSHOperator.Upload
+func (ex ExecOperator) Upload(source io.Reader, target string, mode os.FileMode, owner string) error {
+	if ex.become == nil {
+		script := uploadScript(target, mode, owner, "")
+		if res, err := ex.run(context.Background(), "sh -c "+ShellQuote(script), source, false); err != nil {
+			return fmt.Errorf("unable to copy %s: %s: %s", target, err, strings.TrimSpace(string(res.StdErr)))
+		}
+		return nil
+	}
+
+	staged, err := ioutil.TempFile("", "k2sup")
+	if err != nil {
+		return fmt.Errorf("unable to copy %s: %s", target, err)
 	}
+	defer os.Remove(staged.Name())
 
-	res, err := task.Execute()
+	_, err = io.Copy(staged, source)
+	if closeErr := staged.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return CommandRes{}, err
+		return fmt.Errorf("unable to copy %s: %s", target, err)
+	}
+
+	if res, err := ex.ExecuteStdio(uploadScript(target, mode, owner, staged.Name()), false); err != nil {
+		if err == ErrPasswordRequired || err == ErrPasswordIncorrect {
+			return err
+		}
+		return fmt.Errorf("unable to copy %s: %s: %s", target, err, strings.TrimSpace(string(res.StdErr)))
+	}
+
+	return nil
+}
+
+// Close does nothing, it allows ExecOperator to be used as an Operator
+func (ex ExecOperator) Close() error {
+	return nil
+}
+
+func (ex ExecOperator) ExecuteStdio(command string, stream bool) (CommandRes, error) {
+	return ex.ExecuteStdioContext(context.Background(), command, stream)
+}
+
+// ExecuteStdioContext runs command with bash, the process is killed when
+// ctx is done
+func (ex ExecOperator) ExecuteStdioContext(ctx context.Context, command string, stream bool) (CommandRes, error) {
+	if ex.become == nil {
+		return ex.run(ctx, command, nil, stream)
+	}
+
+	if ex.become.method != BecomeSudo {
+		res, err := ex.run(ctx, ex.become.localCommand(command), os.Stdin, stream)
+		return res, ex.become.check(res, err)
+	}
+
+	res, err := ex.run(ctx, ex.become.command(command), ex.become.stdin(), stream)
+	return res, ex.become.check(res, err)
+}
+
+func (ex ExecOperator) run(ctx context.Context, command string, stdin io.Reader, stream bool) (CommandRes, error) {
+	start := time.Now()
+
+	cmd := exec.Command("/bin/bash", "-c", command)
+	cmd.Stdin = stdin
+
+	// Killing only bash would leave the commands it started running and
+	// holding the output open, so Wait would not return until they exit.
+	// A command reading the terminal stays in the foreground group.
+	group := stdin != os.Stdin
+	if group {
+		setProcessGroup(cmd)
 	}
 
-	return CommandRes{
-		StdErr: []byte(res.Stderr),
-		StdOut: []byte(res.Stdout),
-	}, nil
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+	if stream {
+		streamStdout, streamStderr := ex.outputs()
+		cmd.Stdout = io.MultiWriter(streamStdout, &stdout)
+		cmd.Stderr = io.MultiWriter(streamStderr, &stderr)
+	} else {
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+	}
+
+	if err := cmd.Start(); err != nil {
+		return CommandRes{ExitCode: -1}, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if group {
+				killProcessGroup(cmd)
+			} else {
+				cmd.Process.Kill()
+			}
+		case <-done:
+		}
+	}()
+
+	err := cmd.Wait()
+	close(done)
+
+	res := CommandRes{
+		StdErr:   stderr.Bytes(),
+		StdOut:   stdout.Bytes(),
+		ExitCode: cmd.ProcessState.ExitCode(),
+		Duration: time.Since(start),
+	}
+
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return res, ctxErr
+	}
+
+	// Report a failure the same way as SSHOperator
+	if _, ok := err.(*exec.ExitError); ok && res.ExitCode > 0 {
+		return res, fmt.Errorf("Process exited with status %d", res.ExitCode)
+	}
+
+	return res, err
 }
 
 func (ex ExecOperator) Execute(command string) (CommandRes, error) {
 	return ex.ExecuteStdio(command, true)
 }
+
+func (ex ExecOperator) ExecuteContext(ctx context.Context, command string) (CommandRes, error) {
+	return ex.ExecuteStdioContext(ctx, command, true)
+}
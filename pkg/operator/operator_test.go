@@ -0,0 +1,113 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ExecOperator_ExitCode(t *testing.T) {
+	res, err := ExecOperator{}.ExecuteStdio(`sh -c 'echo x >&2; exit 3'`, false)
+	if err == nil {
+		t.Fatalf("want an error from a command which exits with 3")
+	}
+	if res.ExitCode != 3 {
+		t.Errorf("want exit code 3, got %d", res.ExitCode)
+	}
+	if got := res.StdErrTail(20); got != "x" {
+		t.Errorf("want stderr tail %q, got %q", "x", got)
+	}
+	if want := "Process exited with status 3"; err.Error() != want {
+		t.Errorf("want error %q, got %q", want, err)
+	}
+}
+
+func Test_ExecOperator_Success(t *testing.T) {
+	res, err := ExecOperator{}.ExecuteStdio("echo ok", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ExitCode != 0 || string(res.StdOut) != "ok\n" {
+		t.Errorf("want exit code 0 and output ok, got %d and %q", res.ExitCode, res.StdOut)
+	}
+}
+
+func Test_CommandRes_StdErrTail(t *testing.T) {
+	res, err := ExecOperator{}.ExecuteStdio(`for i in $(seq 1 30); do echo line$i >&2; done; exit 1`, false)
+	if err == nil {
+		t.Fatalf("want an error from a command which exits with 1")
+	}
+
+	lines := strings.Split(res.StdErrTail(20), "\n")
+	if len(lines) != 20 {
+		t.Fatalf("want 20 lines, got %d: %q", len(lines), lines)
+	}
+	for i, line := range lines {
+		if want := fmt.Sprintf("line%d", i+11); line != want {
+			t.Errorf("line %d: want %q, got %q", i, want, line)
+		}
+	}
+
+	short := CommandRes{StdErr: []byte("only\n")}
+	if got := short.StdErrTail(20); got != "only" {
+		t.Errorf("want %q, got %q", "only", got)
+	}
+}
+
+func Test_ExecOperator_Timeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// sleep is started by bash rather than replacing it, as in the steps
+	// of an install, and writes its pid once it runs
+	pidFile := filepath.Join(dir, "pid")
+	command := fmt.Sprintf(`sh -c 'echo $$ > %s; exec sleep 5'; true`, pidFile)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = ExecOperator{}.ExecuteStdioContext(ctx, command, false)
+	if err != context.DeadlineExceeded {
+		t.Errorf("want context.DeadlineExceeded, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("want the command stopped after the timeout, took %s", elapsed)
+	}
+
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The killed process is reaped by init, give it a moment
+	for i := 0; i < 50 && processRunning(pid); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if processRunning(pid) {
+		t.Errorf("want sleep (pid %d) to be killed", pid)
+	}
+}
+
+// processRunning reports whether pid is a process which has not exited
+func processRunning(pid int) bool {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// A zombie has exited and only waits to be reaped
+	fields := strings.Fields(string(data))
+	return len(fields) > 2 && fields[2] != "Z"
+}
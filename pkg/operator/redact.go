@@ -0,0 +1,30 @@
+package ssh
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces secrets in anything printed or logged
+const Redacted = "<redacted>"
+
+// secretKeyPattern matches YAML keys which hold secrets, such as the join
+// token in the RKE2 config, registry credentials in registries.yaml or
+// the client key in a kubeconfig
+var secretKeyPattern = regexp.MustCompile(`(?mi)^(\s*-?\s*"?(?:token|agent-token|password|auth|identity_token|identitytoken|client-key-data)"?\s*:[ \t]*)\S.*$`)
+
+// tokenPattern matches a secure join token as printed by
+// /var/lib/rancher/rke2/server/node-token
+var tokenPattern = regexp.MustCompile(`K10[0-9a-f]{16,}::[^\s'"]+`)
+
+// Redact replaces each of secrets in text, along with join tokens and
+// the value of any YAML key which holds a secret
+func Redact(text string, secrets []string) string {
+	for _, secret := range secrets {
+		if len(strings.TrimSpace(secret)) > 0 {
+			text = strings.Replace(text, strings.TrimSpace(secret), Redacted, -1)
+		}
+	}
+	text = tokenPattern.ReplaceAllString(text, Redacted)
+	return secretKeyPattern.ReplaceAllString(text, "${1}"+Redacted)
+}
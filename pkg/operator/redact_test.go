@@ -0,0 +1,40 @@
+package ssh
+
+import "testing"
+
+func Test_Redact(t *testing.T) {
+	cases := []struct {
+		name    string
+		text    string
+		secrets []string
+		want    string
+	}{
+		{
+			name: "rke2 config",
+			text: "echo 'server: https://10.0.0.1:9345 \ntoken: K10abc::server:def\n' | tee -a /etc/rancher/rke2/config.yaml",
+			want: "echo 'server: https://10.0.0.1:9345 \ntoken: <redacted>\n' | tee -a /etc/rancher/rke2/config.yaml",
+		},
+		{
+			name: "registry credentials",
+			text: "configs:\n  registry.example.com:\n    auth:\n      username: admin\n      password: hunter2\n",
+			want: "configs:\n  registry.example.com:\n    auth:\n      username: admin\n      password: <redacted>\n",
+		},
+		{
+			name: "node-token",
+			text: "K1075a60c0f2e5c1bd7f4a9a1fbd1c1d5bb4bfd20e4d7f1a7a1c3e1d1ab4c3e2d1f::server:4f1ab7d3e3b0c1f2a9d8e7f6a5b4c3d2\n",
+			want: "<redacted>\n",
+		},
+		{
+			name:    "given secrets",
+			text:    "K3S_TOKEN=K10abc sh -",
+			secrets: []string{"K10abc\n", ""},
+			want:    "K3S_TOKEN=<redacted> sh -",
+		},
+	}
+
+	for _, c := range cases {
+		if got := Redact(c.text, c.secrets); got != c.want {
+			t.Errorf("%s: want %q, got %q", c.name, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// initialBackoff is the wait before the first retry, it doubles after
+// every failed attempt up to maxBackoff
+var (
+	initialBackoff = time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// transientErrors are the messages of errors which are expected while a
+// host is still booting, they are matched as text because errors from a
+// bastion or the SSH handshake are not wrapped
+var transientErrors = []string{
+	"connection refused",
+	"connection reset",
+	"no route to host",
+	"network is unreachable",
+	"i/o timeout",
+	"connect failed",
+	"handshake failed: EOF",
+}
+
+// dial calls dialContext, retrying up to c.auth.Retries times with an
+// exponential backoff when the host cannot be reached yet. Failures to
+// authenticate or to verify the host key are returned straight away.
+func (c *Connector) dial(ctx context.Context, via *ssh.Client, address string, config *ssh.ClientConfig, out io.Writer) (*ssh.Client, error) {
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		client, err := dialContext(ctx, via, address, config)
+		if err == nil {
+			return client, nil
+		}
+		if attempt >= c.auth.Retries || ctx.Err() != nil || !isTransient(err) {
+			return nil, err
+		}
+
+		fmt.Fprintf(out, "Waiting for SSH on %s: %s, retrying in %s (attempt %d/%d)\n",
+			address, err, backoff, attempt+1, c.auth.Retries)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// nextBackoff doubles backoff, up to maxBackoff
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff *= 2; backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// handshakeTimeoutError is returned when a host accepts the connection
+// but does not complete the SSH handshake in time, such as while sshd
+// starts, it is a net.Error so that it is retried like other timeouts
+type handshakeTimeoutError struct {
+	address string
+	timeout time.Duration
+}
+
+func (e *handshakeTimeoutError) Error() string {
+	return fmt.Sprintf("ssh handshake with %s timed out after %s", e.address, e.timeout)
+}
+
+func (e *handshakeTimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *handshakeTimeoutError) Temporary() bool {
+	return true
+}
+
+// isTransient reports whether err means the host is not reachable yet,
+// as opposed to refusing the credentials or the host key
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EHOSTUNREACH, syscall.ENETUNREACH} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	msg := err.Error()
+	for _, transient := range transientErrors {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+	return false
+}
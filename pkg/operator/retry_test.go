@@ -0,0 +1,170 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_isTransient(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}
+
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connection refused", err: refused, want: true},
+		{name: "wrapped connection refused", err: fmt.Errorf("dial: %w", refused), want: true},
+		{name: "dial timeout", err: &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, want: true},
+		{name: "i/o timeout text", err: errors.New("read tcp 10.0.0.2:22: i/o timeout"), want: true},
+		{name: "handshake timeout", err: &handshakeTimeoutError{address: "10.0.0.2:22", timeout: time.Second}, want: true},
+		{name: "handshake EOF", err: errors.New("ssh: handshake failed: EOF"), want: true},
+		{name: "bastion connect failed", err: errors.New("unable to reach 10.0.0.2:22 through bastion 10.0.0.1:22: ssh: rejected: connect failed (Connection refused)"), want: true},
+		{name: "no route to host", err: errors.New("dial tcp 10.0.0.2:22: connect: no route to host"), want: true},
+		{name: "unable to authenticate", err: errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain"), want: false},
+		{name: "host key mismatch", err: fmt.Errorf("ssh: handshake failed: %w", &HostKeyMismatchError{Host: "10.0.0.2:22"}), want: false},
+		{name: "cancelled", err: context.Canceled, want: false},
+	}
+	for _, c := range cases {
+		if got := isTransient(c.err); got != c.want {
+			t.Errorf("%s: want %t, got %t for %q", c.name, c.want, got, c.err)
+		}
+	}
+}
+
+// timeoutError is a net.Error which timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_nextBackoff(t *testing.T) {
+	backoff := initialBackoff
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for i, w := range want {
+		if backoff = nextBackoff(backoff); backoff != w {
+			t.Errorf("retry %d: want %s, got %s", i+1, w, backoff)
+		}
+	}
+}
+
+// countingListener accepts connections on a local port, counts them and
+// passes each to handle
+func countingListener(t *testing.T, handle func(net.Conn)) (string, func() int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	mu := sync.Mutex{}
+	count := 0
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			count++
+			mu.Unlock()
+			go handle(conn)
+		}
+	}()
+
+	return listener.Addr().String(), func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return count
+	}
+}
+
+func Test_Connector_dial_Retries(t *testing.T) {
+	defer func(backoff time.Duration) { initialBackoff = backoff }(initialBackoff)
+	initialBackoff = time.Millisecond
+
+	// Closing the connection straight away fails the handshake with EOF,
+	// as sshd does while it starts
+	address, attempts := countingListener(t, func(conn net.Conn) { conn.Close() })
+
+	connector := &Connector{auth: AuthOptions{Retries: 3}}
+	config := &ssh.ClientConfig{User: "k2sup", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	out := &bytes.Buffer{}
+	if _, err := connector.dial(context.Background(), nil, address, config, out); err == nil {
+		t.Fatalf("want an error from a host which never completes the handshake")
+	}
+	if got := attempts(); got != 4 {
+		t.Errorf("want the first attempt and 3 retries, got %d attempts", got)
+	}
+	if got := strings.Count(out.String(), "Waiting for SSH on "+address); got != 3 {
+		t.Errorf("want each retry reported to out, got %q", out.String())
+	}
+}
+
+func Test_Connector_dial_AuthNotRetried(t *testing.T) {
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, errors.New("key not authorized")
+		},
+	}
+	serverConfig.AddHostKey(newHostSigner(t, ssh.KeyAlgoED25519))
+	address, attempts := countingListener(t, func(conn net.Conn) {
+		if _, _, _, err := ssh.NewServerConn(conn, serverConfig); err != nil {
+			conn.Close()
+		}
+	})
+
+	connector := &Connector{auth: AuthOptions{Retries: 3}}
+	config := &ssh.ClientConfig{
+		User:            "k2sup",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(newHostSigner(t, ssh.KeyAlgoECDSA256))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	if _, err := connector.dial(context.Background(), nil, address, config, ioutil.Discard); err == nil {
+		t.Fatalf("want the key to be rejected")
+	}
+	if got := attempts(); got != 1 {
+		t.Errorf("want a rejected key not to be retried, got %d attempts", got)
+	}
+}
+
+func Test_dialContext_HandshakeTimeout(t *testing.T) {
+	// The connection is accepted, but no SSH version is ever sent
+	stalled := make(chan net.Conn, 1)
+	address, _ := countingListener(t, func(conn net.Conn) { stalled <- conn })
+	defer func() {
+		select {
+		case conn := <-stalled:
+			conn.Close()
+		default:
+		}
+	}()
+
+	config := &ssh.ClientConfig{User: "k2sup", HostKeyCallback: ssh.InsecureIgnoreHostKey(), Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	_, err := dialContext(context.Background(), nil, address, config)
+
+	var timeoutErr *handshakeTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("want a handshake timeout, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("want the handshake abandoned after the timeout, took %s", elapsed)
+	}
+	if !isTransient(err) {
+		t.Errorf("want a handshake timeout to be retried")
+	}
+}
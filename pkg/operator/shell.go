@@ -0,0 +1,11 @@
+package ssh
+
+import "strings"
+
+// ShellQuote quotes s as a single word for a POSIX shell
+func ShellQuote(s string) string {
+	if len(s) == 0 {
+		return "''"
+	}
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
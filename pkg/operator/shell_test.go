@@ -0,0 +1,20 @@
+package ssh
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func Test_ShellQuote(t *testing.T) {
+	values := []string{"", "plain", "two words", "it's", `"$HOME" $(id) ; rm -rf /`}
+
+	for _, want := range values {
+		got, err := exec.Command("sh", "-c", "printf %s "+ShellQuote(want)).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("want %q, got %q", want, string(got))
+		}
+	}
+}
@@ -2,30 +2,56 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	"io"
-	"os"
+	"strings"
 	"sync"
-	"fmt"
+	"time"
 
 	"golang.org/x/crypto/ssh"
-
-	"github.com/thanhpk/randstr"
-	scp "github.com/bramvdbogaerde/go-scp"
-	
 )
 
 type SSHOperator struct {
+	streams
+
 	conn *ssh.Client
+
+	// bastions is closed along with conn when the operator was created
+	// with Dial rather than a shared Connector
+	bastions io.Closer
+
+	// become runs every command as root when it is not nil
+	become *become
 }
 
-func (s SSHOperator) Close() error {
+// SetBecome sets how every command is run as root, one of BecomeMethods
+func (s *SSHOperator) SetBecome(method string) error {
+	become, err := newBecome(method)
+	if err != nil {
+		return err
+	}
+	s.become = become
+	return nil
+}
 
-	return s.conn.Close()
+// SetBecomePassword sets the password used to become root, it has no
+// effect unless a method was set with SetBecome
+func (s *SSHOperator) SetBecomePassword(password string) {
+	if s.become != nil {
+		s.become.password = password
+	}
 }
 
+func (s SSHOperator) Close() error {
+	err := s.conn.Close()
+	if s.bastions != nil {
+		s.bastions.Close()
+	}
+	return err
+}
 
 func NewSSHOperator(address string, config *ssh.ClientConfig) (*SSHOperator, error) {
-	conn, err := ssh.Dial("tcp", address, config)
+	conn, err := dialContext(context.Background(), nil, address, config)
 	if err != nil {
 		return nil, err
 	}
@@ -37,46 +63,112 @@ func NewSSHOperator(address string, config *ssh.ClientConfig) (*SSHOperator, err
 	return &operator, nil
 }
 
-func (s SSHOperator) CopySCP(source *os.File, target string) error {
-	client, err := scp.NewClientBySSH(s.conn)
-	if err != nil {
-		return err
+// ExecuteStdio runs command in a new session. The output captured so far
+// is returned along with any error, including when the command exits
+// with a non-zero status.
+func (s SSHOperator) ExecuteStdio(command string, stream bool) (CommandRes, error) {
+	return s.ExecuteStdioContext(context.Background(), command, stream)
+}
+
+// ExecuteStdioContext is ExecuteStdio which stops the command when ctx
+// is done. The remote process is sent SIGTERM and the session is closed,
+// some servers ignore the signal in which case the process is left to
+// fail once its output can no longer be written.
+func (s SSHOperator) ExecuteStdioContext(ctx context.Context, command string, stream bool) (CommandRes, error) {
+	if s.become == nil {
+		return s.run(ctx, command, runOptions{stream: stream})
 	}
 
-	tmpfile := string("/tmp/" + randstr.String(8))
-	err = client.CopyFile(source, tmpfile, "0644")
-	if err != nil {
-		return err
+	// su has no way to be told not to prompt, so it would wait forever
+	if s.become.method == BecomeSu && len(s.become.password) == 0 {
+		return CommandRes{ExitCode: -1}, ErrPasswordRequired
 	}
 
-	s.Execute(fmt.Sprintf("sudo mv %s %s", tmpfile, target))
-	return nil
+	pty := s.become.usePTY()
+	res, err := s.run(ctx, s.become.command(command), s.becomeOptions(stream, pty))
+	if err != nil && !pty && s.become.needsTTY(res) {
+		// Nothing was run, so it is safe to retry
+		s.become.requirePTY()
+		res, err = s.run(ctx, s.become.command(command), s.becomeOptions(stream, true))
+	}
+
+	return res, s.become.check(res, err)
 }
 
-func (s SSHOperator) ExecuteStdio(command string, stream bool) (CommandRes, error) {
+// becomeOptions returns the options for a command run as root, pty is
+// set when the host needs a terminal
+func (s SSHOperator) becomeOptions(stream, pty bool) runOptions {
+	options := runOptions{
+		stdin:  s.become.stdin(),
+		stream: stream,
+		pty:    pty || s.become.terminalPrompt(),
+	}
+	if s.become.terminalPrompt() {
+		options.password = s.become.password
+	}
+	return options
+}
+
+// runOptions configures a session started by run
+type runOptions struct {
+	stdin  io.Reader
+	stream bool
+
+	// pty requests a terminal, without echo so that a password written
+	// to stdin is not shown, stderr is then merged into stdout
+	pty bool
+
+	// password is typed at the first password prompt, see passwordPrompt
+	password string
+}
+
+// run runs command in a new session
+func (s SSHOperator) run(ctx context.Context, command string, options runOptions) (CommandRes, error) {
+	start := time.Now()
+	stream := options.stream
 
 	sess, err := s.conn.NewSession()
 	if err != nil {
-		return CommandRes{}, err
+		return CommandRes{ExitCode: -1}, err
 	}
 
 	defer sess.Close()
 
+	if options.pty {
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          0,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		if err := sess.RequestPty("xterm", 40, 80, modes); err != nil {
+			return CommandRes{ExitCode: -1}, err
+		}
+	}
+	sess.Stdin = options.stdin
+
 	sessStdOut, err := sess.StdoutPipe()
 	if err != nil {
-		return CommandRes{}, err
+		return CommandRes{ExitCode: -1}, err
 	}
 
 	output := bytes.Buffer{}
 	wg := sync.WaitGroup{}
+	streamStdout, streamStderr := s.outputs()
 
 	var stdOutWriter io.Writer
 	if stream {
-		stdOutWriter = io.MultiWriter(os.Stdout, &output)
+		stdOutWriter = io.MultiWriter(streamStdout, &output)
 	} else {
 		stdOutWriter = &output
 	}
 
+	var prompt *passwordPrompt
+	if len(options.password) > 0 {
+		prompt = newPasswordPrompt(options.password, stdOutWriter)
+		stdOutWriter = prompt
+		sess.Stdin = prompt
+	}
+
 	wg.Add(1)
 	go func() {
 		io.Copy(stdOutWriter, sessStdOut)
@@ -85,13 +177,13 @@ func (s SSHOperator) ExecuteStdio(command string, stream bool) (CommandRes, erro
 
 	sessStderr, err := sess.StderrPipe()
 	if err != nil {
-		return CommandRes{}, err
+		return CommandRes{ExitCode: -1}, err
 	}
 
 	errorOutput := bytes.Buffer{}
 	var stdErrWriter io.Writer
 	if stream {
-		stdErrWriter = io.MultiWriter(os.Stderr, &errorOutput)
+		stdErrWriter = io.MultiWriter(streamStderr, &errorOutput)
 	} else {
 		stdErrWriter = &errorOutput
 	}
@@ -102,29 +194,75 @@ func (s SSHOperator) ExecuteStdio(command string, stream bool) (CommandRes, erro
 		wg.Done()
 	}()
 
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sess.Signal(ssh.SIGTERM)
+			sess.Close()
+		case <-done:
+		}
+	}()
+
 	err = sess.Run(command)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		err = ctxErr
+	}
+
+	exitCode := 0
 	if err != nil {
-		return CommandRes{}, err
+		exitCode = -1
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			exitCode = exitErr.ExitStatus()
+		}
 	}
 
+	// The pipes are closed with the session's channel, so the output is
+	// complete even when Run failed part way through
 	wg.Wait()
+	if prompt != nil {
+		prompt.close()
+	}
+
+	stdOut := output.Bytes()
+	if options.pty {
+		stdOut = bytes.Replace(stdOut, []byte("\r\n"), []byte("\n"), -1)
+	}
 
 	return CommandRes{
-		StdErr: errorOutput.Bytes(),
-		StdOut: output.Bytes(),
-	}, nil
+		StdErr:   errorOutput.Bytes(),
+		StdOut:   stdOut,
+		ExitCode: exitCode,
+		Duration: time.Since(start),
+	}, err
 }
 
 func (s SSHOperator) Execute(command string) (CommandRes, error) {
 	return s.ExecuteStdio(command, true)
 }
 
+func (s SSHOperator) ExecuteContext(ctx context.Context, command string) (CommandRes, error) {
+	return s.ExecuteStdioContext(ctx, command, true)
+}
+
 type CommandRes struct {
 	StdOut []byte
 	StdErr []byte
-}
 
-func executeCommand(cmd string) (CommandRes, error) {
+	// ExitCode is the exit status of the command, or -1 when the command
+	// did not run or exited without reporting a status
+	ExitCode int
 
-	return CommandRes{}, nil
+	// Duration is how long the command took to run
+	Duration time.Duration
+}
+
+// StdErrTail returns at most the last n lines written to stderr
+func (res CommandRes) StdErrTail(n int) string {
+	lines := strings.Split(strings.TrimRight(string(res.StdErr), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
 }
@@ -0,0 +1,312 @@
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// maxIncludeDepth matches the recursion limit used by OpenSSH
+const maxIncludeDepth = 16
+
+// HostConfig holds the settings from an OpenSSH client configuration
+// which apply to a single host
+type HostConfig struct {
+	// HostName is the real host name to connect to, it defaults to the
+	// alias which was looked up
+	HostName string
+	User     string
+	Port     int
+
+	// IdentityFiles lists every IdentityFile which applied, in order
+	IdentityFiles []string
+
+	// ProxyJump lists the jump hosts to connect through, in order
+	ProxyJump []string
+}
+
+// SSHConfig is a parsed OpenSSH client configuration file such as
+// ~/.ssh/config. Only the keywords used to reach a host are understood,
+// any other keyword is ignored.
+type SSHConfig struct {
+	blocks []*hostBlock
+}
+
+type hostBlock struct {
+	patterns []string
+	options  []hostOption
+}
+
+type hostOption struct {
+	keyword string
+	args    []string
+}
+
+// LoadSSHConfig parses the OpenSSH client configuration at path,
+// following any Include directives. A missing file is not an error
+// and results in an empty configuration.
+func LoadSSHConfig(path string) (*SSHConfig, error) {
+	c := &SSHConfig{}
+	// Options before the first Host keyword apply to every host
+	global := &hostBlock{patterns: []string{"*"}}
+	c.blocks = append(c.blocks, global)
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return c, nil
+	}
+
+	if err := c.parseFile(path, filepath.Dir(path), global, 0); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func (c *SSHConfig) parseFile(path, baseDir string, block *hostBlock, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: maximum Include depth exceeded", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		keyword, args, err := splitConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineNo, err)
+		}
+		if len(keyword) == 0 {
+			continue
+		}
+
+		switch keyword {
+		case "host":
+			block = &hostBlock{patterns: args}
+			c.blocks = append(c.blocks, block)
+		case "match":
+			// Match criteria are not evaluated, so the options in a Match
+			// block never apply
+			block = &hostBlock{}
+			c.blocks = append(c.blocks, block)
+		case "include":
+			for _, pattern := range args {
+				pattern = expandTilde(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(baseDir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%s:%d: %s", path, lineNo, err)
+				}
+				for _, match := range matches {
+					if err := c.parseFile(match, baseDir, block, depth+1); err != nil {
+						return err
+					}
+				}
+				// A Host keyword inside an included file only lasts until
+				// the end of that file
+				if len(matches) > 0 && c.blocks[len(c.blocks)-1] != block {
+					block = c.continueBlock(block)
+				}
+			}
+		default:
+			block.options = append(block.options, hostOption{keyword: keyword, args: args})
+		}
+	}
+
+	return scanner.Err()
+}
+
+// continueBlock re-opens block after an included file changed the
+// current block, so that later options keep their original scope
+func (c *SSHConfig) continueBlock(block *hostBlock) *hostBlock {
+	next := &hostBlock{patterns: block.patterns}
+	c.blocks = append(c.blocks, next)
+	return next
+}
+
+// Lookup returns the configuration for alias. As with OpenSSH the first
+// value obtained for each keyword wins, apart from IdentityFile which
+// accumulates.
+func (c *SSHConfig) Lookup(alias string) HostConfig {
+	res := HostConfig{}
+	if c == nil {
+		res.HostName = alias
+		return res
+	}
+
+	for _, block := range c.blocks {
+		if !matchHostPatterns(block.patterns, alias) {
+			continue
+		}
+
+		for _, opt := range block.options {
+			if len(opt.args) == 0 {
+				continue
+			}
+			switch opt.keyword {
+			case "hostname":
+				if len(res.HostName) == 0 {
+					res.HostName = opt.args[0]
+				}
+			case "user":
+				if len(res.User) == 0 {
+					res.User = opt.args[0]
+				}
+			case "port":
+				if res.Port == 0 {
+					if port, err := strconv.Atoi(opt.args[0]); err == nil {
+						res.Port = port
+					}
+				}
+			case "identityfile":
+				res.IdentityFiles = append(res.IdentityFiles, opt.args[0])
+			case "proxyjump":
+				if res.ProxyJump == nil {
+					res.ProxyJump = []string{}
+					if !strings.EqualFold(opt.args[0], "none") {
+						res.ProxyJump = strings.Split(opt.args[0], ",")
+					}
+				}
+			}
+		}
+	}
+
+	if len(res.HostName) == 0 {
+		res.HostName = alias
+	} else {
+		res.HostName = strings.Replace(res.HostName, "%h", alias, -1)
+	}
+
+	for i, identityFile := range res.IdentityFiles {
+		res.IdentityFiles[i] = expandTokens(identityFile, res.HostName, res.User)
+	}
+
+	return res
+}
+
+func matchHostPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if !matchPattern(pattern, host) {
+			continue
+		}
+		if negate {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// matchPattern matches host against an OpenSSH pattern where '*'
+// matches zero or more characters and '?' matches exactly one
+func matchPattern(pattern, host string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(host); i >= 0; i-- {
+				if matchPattern(pattern[1:], host[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(host) == 0 {
+				return false
+			}
+		default:
+			if len(host) == 0 || !strings.EqualFold(pattern[:1], host[:1]) {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		host = host[1:]
+	}
+	return len(host) == 0
+}
+
+// splitConfigLine returns the lower-cased keyword and arguments of a
+// configuration line, the keyword may be separated by whitespace or '='
+func splitConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:i])
+	rest := strings.TrimLeft(line[i:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	var args []string
+	var current strings.Builder
+	inQuote := false
+	hasArg := false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			hasArg = true
+		case !inQuote && (r == ' ' || r == '\t'):
+			if hasArg {
+				args = append(args, current.String())
+				current.Reset()
+				hasArg = false
+			}
+		case !inQuote && r == '#' && !hasArg:
+			return keyword, args, nil
+		default:
+			current.WriteRune(r)
+			hasArg = true
+		}
+	}
+	if inQuote {
+		return "", nil, fmt.Errorf("unterminated quote")
+	}
+	if hasArg {
+		args = append(args, current.String())
+	}
+
+	return keyword, args, nil
+}
+
+func expandTilde(path string) string {
+	res, _ := homedir.Expand(path)
+	return res
+}
+
+// expandTokens expands the subset of OpenSSH percent tokens which make
+// sense for IdentityFile
+func expandTokens(value, host, remoteUser string) string {
+	home, _ := homedir.Dir()
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+
+	replacer := strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", host,
+		"%r", remoteUser,
+		"%u", localUser,
+	)
+	return expandTilde(replacer.Replace(value))
+}
@@ -0,0 +1,95 @@
+package ssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const sshConfigExample = `
+# Applies to everything, but later values never override earlier ones
+Include conf.d/*
+
+Host server0 server1
+  HostName 10.0.0.10
+  User nick
+  Port 2222
+  IdentityFile ~/.ssh/rke2_ed25519
+
+Host *.internal !bastion.internal
+  ProxyJump jump@bastion.internal:22,second
+
+Host *
+  User root
+  IdentityFile "%d/.ssh/id_rsa"
+`
+
+const sshConfigInclude = `
+Host agent?
+  HostName=192.168.0.20
+  ProxyJump none
+`
+
+func Test_SSHConfigLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "conf.d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "conf.d", "agents"), []byte(sshConfigInclude), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(configPath, []byte(sshConfigExample), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadSSHConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	home := expandTilde("~")
+
+	server := config.Lookup("server1")
+	if server.HostName != "10.0.0.10" || server.User != "nick" || server.Port != 2222 {
+		t.Fatalf("unexpected config for server1: %+v", server)
+	}
+	wantKeys := []string{home + "/.ssh/rke2_ed25519", home + "/.ssh/id_rsa"}
+	if !reflect.DeepEqual(server.IdentityFiles, wantKeys) {
+		t.Fatalf("want identity files: %q, but got: %q", wantKeys, server.IdentityFiles)
+	}
+
+	agent := config.Lookup("agent3")
+	if agent.HostName != "192.168.0.20" || agent.User != "root" || len(agent.ProxyJump) != 0 {
+		t.Fatalf("unexpected config for agent3: %+v", agent)
+	}
+
+	internal := config.Lookup("db.internal")
+	wantJump := []string{"jump@bastion.internal:22", "second"}
+	if internal.HostName != "db.internal" || !reflect.DeepEqual(internal.ProxyJump, wantJump) {
+		t.Fatalf("unexpected config for db.internal: %+v", internal)
+	}
+
+	if bastion := config.Lookup("bastion.internal"); len(bastion.ProxyJump) != 0 {
+		t.Fatalf("want negated pattern to skip ProxyJump, but got: %q", bastion.ProxyJump)
+	}
+}
+
+func Test_LoadSSHConfigMissingFile(t *testing.T) {
+	config, err := LoadSSHConfig(filepath.Join(os.TempDir(), "k2sup-missing-ssh-config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := config.Lookup("server0")
+	if res.HostName != "server0" || res.Port != 0 || len(res.User) != 0 {
+		t.Fatalf("want empty config, but got: %+v", res)
+	}
+}
@@ -0,0 +1,155 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Uploader writes files to a host
+type Uploader interface {
+	// Upload writes the contents of source to target with mode, and with
+	// owner when it is not empty. Readers never see a partial file.
+	Upload(source io.Reader, target string, mode os.FileMode, owner string) error
+}
+
+// uploadScript returns a script which writes the file at staged, or
+// stdin when staged is empty, to a temporary file beside target so that
+// the final rename cannot cross file systems. mktemp creates the file
+// readable only by its owner, so the contents are never visible to other
+// users before the mode is set.
+func uploadScript(target string, mode os.FileMode, owner, staged string) string {
+	dir := path.Dir(target)
+	source := ""
+	cleanup := `rm -f "$tmp"`
+	if len(staged) > 0 {
+		source = " " + ShellQuote(staged)
+		cleanup += " " + ShellQuote(staged)
+	}
+
+	lines := []string{
+		"set -e",
+		"mkdir -p " + ShellQuote(dir),
+		"tmp=$(mktemp " + ShellQuote(dir) + "/.k2sup.XXXXXX)",
+		"trap " + ShellQuote(cleanup) + " EXIT",
+		`cat` + source + ` > "$tmp"`,
+		`sync "$tmp" 2>/dev/null || sync`,
+		fmt.Sprintf(`chmod %04o "$tmp"`, mode.Perm()),
+	}
+	if len(owner) > 0 {
+		lines = append(lines, `chown `+ShellQuote(owner)+` "$tmp"`)
+	}
+	lines = append(lines, `mv -f "$tmp" `+ShellQuote(target))
+	if len(staged) > 0 {
+		lines = append(lines, "rm -f "+ShellQuote(staged))
+	}
+	lines = append(lines, "trap - EXIT")
+
+	return strings.Join(lines, "\n")
+}
+
+// stageScript writes stdin to a new temporary file and prints its path
+const stageScript = `tmp=$(mktemp) && { cat > "$tmp" && echo "$tmp" || { rm -f "$tmp"; exit 1; }; }`
+
+// Upload streams source to the host over the SSH session's stdin, into a
+// temporary file beside target, rather than with the sftp subsystem which
+// can only write as the login user. When becoming root the file is piped
+// straight into the script run as root, apart from with su, or doas with
+// a password, as they only read the password from a terminal which would
+// mangle the file. It is then staged as the login user and moved into
+// place as root.
+func (s SSHOperator) Upload(source io.Reader, target string, mode os.FileMode, owner string) error {
+	if s.become == nil {
+		script := uploadScript(target, mode, owner, "")
+		if res, err := s.run(context.Background(), "sh -c "+ShellQuote(script), runOptions{stdin: source}); err != nil {
+			return fmt.Errorf("unable to upload %s: %s: %s", target, err, strings.TrimSpace(string(res.StdErr)))
+		}
+		return nil
+	}
+
+	if s.become.method == BecomeSu && len(s.become.password) == 0 {
+		return ErrPasswordRequired
+	}
+	if s.become.terminalPrompt() || s.become.usePTY() {
+		return s.uploadStaged(source, target, mode, owner)
+	}
+
+	// The source is read again if sudo turns out to need a terminal
+	seeker, seekable := source.(io.Seeker)
+	start := int64(0)
+	if seekable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seekable = false
+		}
+	}
+
+	res, err := s.run(context.Background(), s.become.streamCommand(s.streamScript(target, mode, owner)), runOptions{stdin: s.streamStdin(source)})
+	if err == nil {
+		return nil
+	}
+	if s.become.needsTTY(res) {
+		s.become.requirePTY()
+		if seekable {
+			if _, err := seeker.Seek(start, io.SeekStart); err == nil {
+				return s.uploadStaged(source, target, mode, owner)
+			}
+		}
+	}
+	if err = s.become.check(res, err); err == ErrPasswordRequired || err == ErrPasswordIncorrect {
+		return err
+	}
+	return fmt.Errorf("unable to upload %s: %s: %s", target, err, strings.TrimSpace(string(res.StdErr)))
+}
+
+// uploadMarker is written after the password to become root when a file
+// is piped to the script run as root, see streamScript
+const uploadMarker = "k2sup-upload"
+
+// streamScript is uploadScript reading the file from stdin. sudo does
+// not read the password from stdin when its credentials are cached or
+// none is needed, so the script first skips past the password to the
+// marker line.
+func (s SSHOperator) streamScript(target string, mode os.FileMode, owner string) string {
+	script := uploadScript(target, mode, owner, "")
+	if len(s.become.password) == 0 {
+		return script
+	}
+
+	skip := `IFS= read -r line || exit 1
+[ "$line" = ` + uploadMarker + ` ] || { IFS= read -r line && [ "$line" = ` + uploadMarker + ` ]; } || exit 1
+`
+	return skip + script
+}
+
+// streamStdin returns the input for streamScript
+func (s SSHOperator) streamStdin(source io.Reader) io.Reader {
+	if len(s.become.password) == 0 {
+		return source
+	}
+	return io.MultiReader(s.become.stdin(), strings.NewReader(uploadMarker+"\n"), source)
+}
+
+// uploadStaged writes source to a temporary file as the login user, since
+// the password to become root can only be typed at a terminal, then moves
+// it into place as root
+func (s SSHOperator) uploadStaged(source io.Reader, target string, mode os.FileMode, owner string) error {
+	res, err := s.run(context.Background(), "sh -c "+ShellQuote(stageScript), runOptions{stdin: source})
+	if err != nil {
+		return fmt.Errorf("unable to upload %s: %s: %s", target, err, strings.TrimSpace(string(res.StdErr)))
+	}
+	staged := strings.TrimSpace(string(res.StdOut))
+
+	if res, err := s.ExecuteStdio(uploadScript(target, mode, owner, staged), false); err != nil {
+		s.run(context.Background(), "rm -f "+ShellQuote(staged), runOptions{})
+		if err == ErrPasswordRequired || err == ErrPasswordIncorrect {
+			return err
+		}
+		return fmt.Errorf("unable to upload %s: %s: %s", target, err, strings.TrimSpace(string(res.StdErr)+string(res.StdOut)))
+	}
+
+	return nil
+}
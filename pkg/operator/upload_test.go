@@ -0,0 +1,257 @@
+package ssh
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// assertUploaded checks that target holds contents with mode 0600, and
+// that it is the only file left in its directory
+func assertUploaded(t *testing.T, target, contents string) {
+	t.Helper()
+
+	got, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != contents {
+		t.Errorf("want contents %q, got %q", contents, got)
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("want mode 0600, got %04o", mode)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Dir(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("want only %s left behind, got %v", filepath.Base(target), names)
+	}
+}
+
+func Test_ExecOperator_Upload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The directory is created, and an existing file replaced
+	target := filepath.Join(dir, "config.yaml.d", "config.yaml")
+	for _, contents := range []string{"token: first\n", "token: second\n"} {
+		if err := (ExecOperator{}).Upload(strings.NewReader(contents), target, 0600, ""); err != nil {
+			t.Fatal(err)
+		}
+		assertUploaded(t, target, contents)
+	}
+}
+
+func Test_ExecOperator_Upload_ReplacesMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(target, []byte("token: old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (ExecOperator{}).Upload(strings.NewReader("token: new\n"), target, 0600, ""); err != nil {
+		t.Fatal(err)
+	}
+	assertUploaded(t, target, "token: new\n")
+}
+
+func Test_ExecOperator_Upload_Become(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// sudo runs the command as the current user, and the file is staged
+	// in a directory of its own so that any leftover is seen
+	binDir, stageDir, targetDir := filepath.Join(dir, "bin"), filepath.Join(dir, "stage"), filepath.Join(dir, "target")
+	for _, d := range []string{binDir, stageDir, targetDir} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(binDir, "sudo"), []byte(fakeBecome), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", stageDir)
+
+	ex := &ExecOperator{}
+	if err := ex.SetBecome(BecomeSudo); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(targetDir, "config.yaml")
+	if err := ex.Upload(strings.NewReader("token: secret\n"), target, 0600, ""); err != nil {
+		t.Fatal(err)
+	}
+	assertUploaded(t, target, "token: secret\n")
+
+	if staged, _ := ioutil.ReadDir(stageDir); len(staged) != 0 {
+		t.Errorf("want the staged copy removed, got %d files", len(staged))
+	}
+}
+
+// fakeSudo checks the password read with -S, then runs the wrapped
+// command as the current user
+const fakeSudo = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-S) IFS= read -r password; [ "$password" = secret ] || { echo "sudo: 1 incorrect password attempt" >&2; exit 1; }; shift ;;
+	-p) shift 2 ;;
+	-*) shift ;;
+	*) break ;;
+	esac
+done
+exec "$@"
+`
+
+// serveExec accepts sessions which run their command with sh and env
+func serveExec(t *testing.T, env []string) string {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(newHostSigner(t, ssh.KeyAlgoED25519))
+
+	return serveSSHChannels(t, config, func(newChannel ssh.NewChannel) {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions in tests")
+			return
+		}
+		channel, reqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		defer channel.Close()
+
+		for req := range reqs {
+			if req.Type != "exec" {
+				req.Reply(false, nil)
+				continue
+			}
+			payload := struct{ Command string }{}
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			cmd := exec.Command("sh", "-c", payload.Command)
+			cmd.Env = env
+			cmd.Stdin = channel
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			status := uint32(0)
+			if err := cmd.Run(); err != nil {
+				status = 1
+				if exitErr, ok := err.(*exec.ExitError); ok {
+					status = uint32(exitErr.ExitCode())
+				}
+			}
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		}
+	})
+}
+
+func Test_SSHOperator_Upload_Become(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := "token: secret\n\x00binary\r\nk2sup-upload\n"
+	cases := []struct {
+		name     string
+		sudo     string
+		password string
+	}{
+		{"without a password", fakeBecome, ""},
+		{"with a password", fakeSudo, "secret"},
+		// sudo does not read the password when its credentials are cached
+		{"with cached credentials", fakeBecome, "secret"},
+	}
+
+	for i, c := range cases {
+		caseDir := filepath.Join(dir, string(rune('a'+i)))
+		binDir, targetDir := filepath.Join(caseDir, "bin"), filepath.Join(caseDir, "target")
+		for _, d := range []string{binDir, targetDir} {
+			if err := os.MkdirAll(d, 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(binDir, "sudo"), []byte(c.sudo), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		// Nothing can be staged in a TMPDIR which does not exist, so the
+		// file has to be piped straight to the target directory
+		env := []string{"PATH=" + binDir + ":" + os.Getenv("PATH"), "TMPDIR=" + filepath.Join(caseDir, "missing")}
+		sshOperator := dialOperator(t, caseDir, serveExec(t, env))
+		if err := sshOperator.SetBecome(BecomeSudo); err != nil {
+			t.Fatal(err)
+		}
+		sshOperator.SetBecomePassword(c.password)
+
+		target := filepath.Join(targetDir, "config.yaml")
+		if err := sshOperator.Upload(strings.NewReader(contents), target, 0600, ""); err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		} else {
+			assertUploaded(t, target, contents)
+		}
+		sshOperator.Close()
+	}
+}
+
+func Test_SSHOperator_Upload_WrongPassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k2sup-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "sudo"), []byte(fakeSudo), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sshOperator := dialOperator(t, dir, serveExec(t, []string{"PATH=" + dir + ":" + os.Getenv("PATH")}))
+	defer sshOperator.Close()
+	if err := sshOperator.SetBecome(BecomeSudo); err != nil {
+		t.Fatal(err)
+	}
+	sshOperator.SetBecomePassword("wrong")
+
+	target := filepath.Join(dir, "target", "config.yaml")
+	if err := sshOperator.Upload(strings.NewReader("token: secret\n"), target, 0600, ""); err != ErrPasswordIncorrect {
+		t.Errorf("want ErrPasswordIncorrect, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(target)); !os.IsNotExist(err) {
+		t.Errorf("want nothing written for a rejected password")
+	}
+}